@@ -1,14 +1,117 @@
 package fastlike
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http2"
 )
 
+// BackendConfig describes a backend which proxies subrequests to a real origin over the network
+type BackendConfig struct {
+	// URL is the address of the origin. Subrequests have their scheme and host replaced with
+	// the ones from URL, and its path is prefixed to theirs.
+	URL string
+
+	// PinIP, if set, makes connections to the origin go to this address regardless of what the
+	// hostname in URL resolves to. The request itself, including TLS verification, still uses
+	// the hostname. PinIP takes precedence over WithHostsMap.
+	PinIP net.IP
+
+	// OverrideHost, if set, replaces the Host header on requests sent to the origin. By default,
+	// the Host header of the subrequest is kept as-is.
+	OverrideHost string
+
+	// SNIHostname, if set, is the server name sent to the origin during the TLS handshake. By
+	// default, it's the hostname from URL.
+	SNIHostname string
+
+	// CertHostname, if set, is the hostname the origin certificate is verified against. By
+	// default, it's the same as the SNI hostname.
+	CertHostname string
+
+	// RootCAs is the set of root certificates used to verify the origin certificate. If nil, the
+	// system roots are used.
+	RootCAs *x509.CertPool
+
+	// IdleConnTimeout is how long an idle connection to the origin is kept open for reuse.
+	// Defaults to 90 seconds.
+	IdleConnTimeout time.Duration
+
+	// MaxIdleConns is the maximum number of idle connections kept open to the origin. Defaults to
+	// 100.
+	MaxIdleConns int
+
+	// LatencyFunc, if set, is called for every subrequest and the subrequest is held back for the
+	// returned duration before it's sent to the origin. This can be used to simulate slow origins;
+	// see ConstantLatency and UniformLatency. If the subrequest is canceled while it's held back,
+	// it fails with a 502 without reaching the origin.
+	LatencyFunc func() time.Duration
+
+	// HTTP2, if set, makes subrequests to the origin use HTTP/2. Origins with an https URL must
+	// negotiate h2 with ALPN, and origins with an http URL are sent cleartext HTTP/2 (h2c) with
+	// prior knowledge. The response version seen by the guest is the one the origin used.
+	HTTP2 bool
+
+	// TruncateAfter, if greater than zero, cuts off response bodies after this many bytes as if the
+	// connection to the origin dropped. Reading the rest of the body fails, instead of ending
+	// cleanly.
+	TruncateAfter int64
+
+	// CircuitBreaker, if set, stops subrequests from reaching the origin while it's failing. Keep
+	// a reference to it to inspect its state.
+	CircuitBreaker *CircuitBreaker
+
+	// RequestHeaderFunc, if set, is called with the headers of every subrequest just before it's
+	// sent to the origin, after fastlike has added its own, such as cdn-loop. Changes to it are
+	// never seen by the guest. Use OverrideHost to change the Host header.
+	RequestHeaderFunc func(http.Header)
+
+	// ResponseHeaderFunc, if set, is called with the headers of every response from the origin
+	// before the guest sees them.
+	ResponseHeaderFunc func(http.Header)
+}
+
+// ConstantLatency returns a BackendConfig.LatencyFunc which always delays subrequests by d
+func ConstantLatency(d time.Duration) func() time.Duration {
+	return func() time.Duration {
+		return d
+	}
+}
+
+// UniformLatency returns a BackendConfig.LatencyFunc which delays subrequests by a random duration
+// in [min, max)
+func UniformLatency(min, max time.Duration) func() time.Duration {
+	return func() time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(rand.Int63n(int64(max-min)))
+	}
+}
+
 func (i *Instance) addBackend(name string, h http.Handler) {
+	delete(i.transports, name)
 	i.backends[name] = h
 }
 
+func (i *Instance) addBackendTransport(name string, rt http.RoundTripper) {
+	delete(i.backends, name)
+	i.transports[name] = rt
+}
+
 func (i *Instance) getBackend(name string) http.Handler {
 	h, ok := i.backends[name]
 	if !ok {
@@ -18,6 +121,51 @@ func (i *Instance) getBackend(name string) http.Handler {
 	return h
 }
 
+// getTransport returns the http.RoundTripper used to send subrequests to the named backend.
+// Backends registered as an http.Handler are adapted to one. Unregistered backends use the default
+// transport, if there is one and it returns one for name, or the default backend otherwise.
+func (i *Instance) getTransport(name string) http.RoundTripper {
+	var rt, ok = i.transports[name]
+	if _, isHandler := i.backends[name]; !ok && !isHandler && i.defaultTransport != nil {
+		rt = i.defaultTransport(name)
+	}
+	if rt == nil {
+		rt = handlerTransport{i.getBackend(name)}
+	}
+
+	if v, ok := i.vcrs[name]; ok {
+		return v.transport(rt)
+	}
+
+	if i.recordings != nil {
+		if v := i.recordings.get(name); v != nil {
+			return v.transport(rt)
+		}
+	}
+
+	return rt
+}
+
+// addMirror makes subrequests sent to primary also get sent to mirror
+func (i *Instance) addMirror(primary, mirror string) {
+	i.mirrors[primary] = append(i.mirrors[primary], mirror)
+}
+
+// mirror sends a copy of req to the named backend in the background, discarding the response. The
+// copy shares the context of req, so it's canceled when the downstream request finishes and it
+// follows the instance's clock and hosts map.
+func (i *Instance) mirror(name string, req *http.Request, body []byte) {
+	var mr = req.Clone(req.Context())
+	mr.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var rt = i.getTransport(name)
+	go func() {
+		var res = fetch(rt, mr)
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+}
+
 func defaultBackend(name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadGateway)
@@ -25,3 +173,320 @@ func defaultBackend(name string) http.Handler {
 		w.Write([]byte(msg))
 	})
 }
+
+// Handler returns an http.Handler which proxies requests to the configured origin. It's what
+// WithBackendConfig registers, and can be used with WithDefaultBackend as well.
+func (c BackendConfig) Handler() (http.Handler, error) {
+	origin, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var proxy = httputil.NewSingleHostReverseProxy(origin)
+	proxy.Transport, err = c.roundTripper(origin)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy.ModifyResponse = func(res *http.Response) error {
+		if p, ok := res.Request.Context().Value(connKey{}).(*backendConn); ok {
+			p.major, p.minor = res.ProtoMajor, res.ProtoMinor
+			p.tls = res.TLS
+		}
+		if c.ResponseHeaderFunc != nil {
+			c.ResponseHeaderFunc(res.Header)
+		}
+		return nil
+	}
+
+	if c.OverrideHost != "" {
+		var director = proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			r.Host = c.OverrideHost
+		}
+	}
+
+	if c.RequestHeaderFunc != nil {
+		var director = proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			c.RequestHeaderFunc(r.Header)
+		}
+	}
+
+	var h http.Handler = proxy
+	if c.TruncateAfter > 0 {
+		h = truncated(h, c.TruncateAfter)
+	}
+	if c.LatencyFunc != nil {
+		h = delayed(h, c.LatencyFunc)
+	}
+
+	// The breaker goes on the outside, so that failing fast skips the simulated latency too
+	if c.CircuitBreaker != nil {
+		h = c.CircuitBreaker.handler(h)
+	}
+
+	return h, nil
+}
+
+// Subrequest describes a subrequest sent by the guest, once the backend has responded to it
+type Subrequest struct {
+	// Backend is the name of the backend the guest sent the subrequest to
+	Backend string
+
+	Method string
+	URL    string
+
+	// StatusCode is the status of the response from the backend
+	StatusCode int
+
+	// SNI is the server name sent to the origin during the TLS handshake. It's empty when the
+	// backend isn't a BackendConfig origin reached over TLS.
+	SNI string
+}
+
+// recordedTransport is an http.RoundTripper which passes the outcome of every request sent with rt
+// to fn
+type recordedTransport struct {
+	rt      http.RoundTripper
+	backend string
+	fn      func(Subrequest)
+}
+
+func (t recordedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var res = fetch(t.rt, r)
+
+	var s = Subrequest{Backend: t.backend, Method: r.Method, URL: r.URL.String(), StatusCode: res.StatusCode}
+	if res.TLS != nil {
+		s.SNI = res.TLS.ServerName
+	}
+	t.fn(s)
+
+	return res, nil
+}
+
+// truncated returns an http.Handler which aborts each response from h after n bytes of body. The
+// response headers, including any Content-Length, are sent as-is.
+func truncated(h http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&truncateWriter{ResponseWriter: w, left: n}, r)
+	})
+}
+
+// truncateWriter is an http.ResponseWriter which passes the first left bytes of the body on to the
+// underlying writer, then flushes them and aborts the response
+type truncateWriter struct {
+	http.ResponseWriter
+	left int64
+}
+
+func (w *truncateWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= w.left {
+		n, err := w.ResponseWriter.Write(p)
+		w.left -= int64(n)
+		return n, err
+	}
+
+	w.ResponseWriter.Write(p[:w.left])
+	w.left = 0
+	w.Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func (w *truncateWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// delayed returns an http.Handler which waits for a duration sampled from latency before passing
+// each request on to h. The wait is measured with the clock of the instance sending the request.
+func delayed(h http.Handler, latency func() time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d := latency(); d > 0 {
+			select {
+			case <-clockFromContext(r.Context()).After(d):
+			case <-r.Context().Done():
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// transport returns the http.Transport used to talk to the origin
+func (c BackendConfig) transport() *http.Transport {
+	var dialer = &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	var t = http.DefaultTransport.(*http.Transport).Clone()
+	if c.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = c.IdleConnTimeout
+	}
+
+	// Each backend only talks to a single origin, so the per-host limit is the one that matters
+	t.MaxIdleConnsPerHost = t.MaxIdleConns
+	if c.MaxIdleConns > 0 {
+		t.MaxIdleConns = c.MaxIdleConns
+		t.MaxIdleConnsPerHost = c.MaxIdleConns
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		addr, err := c.resolve(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	t.TLSClientConfig = &tls.Config{
+		ServerName: c.SNIHostname,
+		RootCAs:    c.RootCAs,
+	}
+
+	// When the certificate is verified against a different name than the one we send via SNI, we
+	// have to take over verification from crypto/tls
+	if c.CertHostname != "" && c.CertHostname != c.SNIHostname {
+		t.TLSClientConfig.InsecureSkipVerify = true
+		t.TLSClientConfig.VerifyConnection = verifyHostname(c.RootCAs, c.CertHostname)
+	}
+
+	return t
+}
+
+// resolve returns the address to dial for addr, which is PinIP if it's set and otherwise the
+// address from the hosts map on ctx, if there is one
+func (c BackendConfig) resolve(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if c.PinIP != nil {
+		return net.JoinHostPort(c.PinIP.String(), port), nil
+	} else if ip, ok := hostsFromContext(ctx)[host]; ok {
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+
+	return addr, nil
+}
+
+// roundTripper returns the http.RoundTripper used to talk to the origin, which speaks whatever
+// protocol was configured
+func (c BackendConfig) roundTripper(origin *url.URL) (http.RoundTripper, error) {
+	if !c.HTTP2 {
+		return c.transport(), nil
+	}
+
+	if origin.Scheme == "https" {
+		var t = c.transport()
+		if err := http2.ConfigureTransport(t); err != nil {
+			return nil, err
+		}
+
+		// Only offer h2 during ALPN, so that we fail rather than quietly fall back to HTTP/1.1
+		t.TLSClientConfig.NextProtos = []string{"h2"}
+		return t, nil
+	}
+
+	var dialer = &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return h2cTransport{
+		config: c,
+		t: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+		},
+	}, nil
+}
+
+// h2cTransport sends cleartext HTTP/2 requests with prior knowledge. The http2 transport doesn't
+// pass the request context to its dialer, so PinIP and the hosts map are applied to the request URL
+// before it goes out.
+type h2cTransport struct {
+	config BackendConfig
+	t      *http2.Transport
+}
+
+func (h h2cTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var addr = r.URL.Host
+	if r.URL.Port() == "" {
+		addr = net.JoinHostPort(r.URL.Hostname(), "80")
+	}
+
+	resolved, err := h.config.resolve(r.Context(), addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var out = r.Clone(r.Context())
+	out.URL.Host = resolved
+	if out.Host == "" {
+		out.Host = r.URL.Host
+	}
+
+	return h.t.RoundTrip(out)
+}
+
+type connKey struct{}
+
+// backendConn records details of the connection an origin responded on. Subrequests to handlers go
+// through a ResponseRecorder, which always reports HTTP/1.1 and has no connection, so they travel
+// on the context instead.
+type backendConn struct {
+	major, minor int
+
+	// tls is the state of the connection to the origin, nil if it didn't use TLS
+	tls *tls.ConnectionState
+}
+
+func withBackendConn(ctx context.Context, p *backendConn) context.Context {
+	return context.WithValue(ctx, connKey{}, p)
+}
+
+type hostsKey struct{}
+
+// withHosts returns a copy of ctx carrying a static hostname to ip mapping used when dialing
+// origins. Backend transports are shared between instances, so per-instance settings travel with
+// the subrequest instead.
+func withHosts(ctx context.Context, hosts map[string]net.IP) context.Context {
+	return context.WithValue(ctx, hostsKey{}, hosts)
+}
+
+func hostsFromContext(ctx context.Context) map[string]net.IP {
+	hosts, _ := ctx.Value(hostsKey{}).(map[string]net.IP)
+	return hosts
+}
+
+// verifyHostname returns a tls.Config.VerifyConnection callback which verifies the peer certificate
+// chain against the supplied hostname, rather than the server name used for the handshake
+func verifyHostname(roots *x509.CertPool, name string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("origin did not present a certificate")
+		}
+
+		var opts = x509.VerifyOptions{
+			DNSName:       name,
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
@@ -0,0 +1,676 @@
+package fastlike
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestBackendConfigPinIP(t *testing.T) {
+	var got *http.Request
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer origin.Close()
+
+	u, _ := url.Parse(origin.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	// This hostname doesn't resolve, so the only way the request gets through is via the pinned ip
+	h, err := BackendConfig{
+		URL:   "http://origin.invalid:" + port,
+		PinIP: net.ParseIP("127.0.0.1"),
+	}.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://origin.invalid:"+port+"/pinned", nil)
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusTeapot {
+		t.Fatalf("expected status %d, got %d", http.StatusTeapot, w.Code)
+	}
+	if got.URL.Path != "/pinned" {
+		t.Errorf("expected path %q, got %q", "/pinned", got.URL.Path)
+	}
+	if got.Host != "origin.invalid:"+port {
+		t.Errorf("expected host %q, got %q", "origin.invalid:"+port, got.Host)
+	}
+}
+
+func TestBackendConfigHostnames(t *testing.T) {
+	var host, sni string
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	origin.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, nil
+		},
+	}
+	origin.StartTLS()
+	defer origin.Close()
+
+	var roots = x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+
+	var cases = []struct {
+		name         string
+		certHostname string
+		status       int
+	}{
+		// The test server certificate is only valid for example.com
+		{"valid-cert-hostname", "example.com", http.StatusTeapot},
+		{"invalid-cert-hostname", "sni.test", http.StatusBadGateway},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			host, sni = "", ""
+			h, err := BackendConfig{
+				URL:          origin.URL,
+				OverrideHost: "host.test",
+				SNIHostname:  "sni.test",
+				CertHostname: c.certHostname,
+				RootCAs:      roots,
+			}.Handler()
+			if err != nil {
+				st.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "http://guest.test/", nil)
+			h.(*httputil.ReverseProxy).ErrorLog = log.New(ioutil.Discard, "", 0)
+			h.ServeHTTP(w, r)
+
+			if w.Code != c.status {
+				st.Fatalf("expected status %d, got %d", c.status, w.Code)
+			}
+			if sni != "sni.test" {
+				st.Errorf("expected sni %q, got %q", "sni.test", sni)
+			}
+			if c.status == http.StatusTeapot && host != "host.test" {
+				st.Errorf("expected host %q, got %q", "host.test", host)
+			}
+		})
+	}
+}
+
+func TestBackendConfigOverrideHost(t *testing.T) {
+	var host string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer origin.Close()
+
+	var cases = []struct {
+		name     string
+		config   BackendConfig
+		header   string
+		expected string
+	}{
+		{"request host", BackendConfig{URL: origin.URL}, "", "localhost"},
+		{"guest host header", BackendConfig{URL: origin.URL}, "guest.test", "guest.test"},
+		{"override host", BackendConfig{URL: origin.URL, OverrideHost: "host.test"}, "guest.test", "host.test"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			host = ""
+			i := newTestInstance(st, WithBackendConfig("backend", c.config))
+
+			rhid, rh := i.requests.New()
+			rh.Method = "GET"
+			rh.URL, _ = url.Parse("http://localhost/")
+			rh.Header = http.Header{}
+			if c.header != "" {
+				rh.Header.Set("Host", c.header)
+			}
+			bhid, _ := i.bodies.NewBuffer()
+
+			i.memory.WriteAt([]byte("backend"), 200)
+			if s := i.xqd_req_send(int32(rhid), int32(bhid), 200, 7, 100, 104); s != XqdStatusOK {
+				st.Fatalf("send: expected status %d, got %d", XqdStatusOK, s)
+			}
+			if host != c.expected {
+				st.Errorf("expected the origin to see host %q, got %q", c.expected, host)
+			}
+		})
+	}
+}
+
+func TestBackendConfigIdleConns(t *testing.T) {
+	var cases = []struct {
+		name  string
+		cfg   BackendConfig
+		conns int32
+	}{
+		{"reused", BackendConfig{}, 1},
+		{"expired", BackendConfig{IdleConnTimeout: time.Millisecond}, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			var conns int32
+			origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			origin.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt32(&conns, 1)
+				}
+			}
+			origin.Start()
+			defer origin.Close()
+
+			c.cfg.URL = origin.URL
+			h, err := c.cfg.Handler()
+			if err != nil {
+				st.Fatal(err)
+			}
+
+			for j := 0; j < 2; j++ {
+				r, _ := http.NewRequest("GET", "http://guest.test/", nil)
+				h.ServeHTTP(httptest.NewRecorder(), r)
+				<-time.After(50 * time.Millisecond)
+			}
+
+			if n := atomic.LoadInt32(&conns); n != c.conns {
+				st.Errorf("expected %d connections, got %d", c.conns, n)
+			}
+		})
+	}
+}
+
+func TestMirror(t *testing.T) {
+	var release = make(chan struct{})
+	var mirrored = make(chan string, 1)
+
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusTeapot)
+		w.Write(body)
+	})
+
+	// The mirror doesn't finish until after the downstream request, and must see its context
+	// canceled once the downstream request is done
+	shadow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+		mirrored <- string(body)
+	})
+
+	r, _ := http.NewRequest("POST", "http://localhost:1337/mirror", strings.NewReader("mirror me"))
+	w := serve(t, proxyWat, r,
+		WithBackend("backend", primary),
+		WithBackend("shadow", shadow),
+		WithMirror("backend", "shadow"),
+	)
+	close(release)
+
+	if w.Code != http.StatusTeapot || w.Body.String() != "mirror me" {
+		t.Errorf("expected primary response 418 %q, got %d %q", "mirror me", w.Code, w.Body.String())
+	}
+
+	select {
+	case body := <-mirrored:
+		if body != "mirror me" {
+			t.Errorf("expected mirror to receive %q, got %q", "mirror me", body)
+		}
+	case <-time.After(time.Second):
+		t.Error("mirror request was never canceled")
+	}
+}
+
+func TestMirrorHostsMap(t *testing.T) {
+	var mirrored = make(chan struct{}, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- struct{}{}
+	}))
+	defer origin.Close()
+
+	u, _ := url.Parse(origin.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	// The shadow's hostname only resolves through the hosts map. Subrequests are sent outside of
+	// serve here, so there's no downstream context either.
+	i := newTestInstance(t,
+		WithBackend("backend", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})),
+		WithBackendConfig("shadow", BackendConfig{URL: "http://shadow.example.invalid:" + port}),
+		WithMirror("backend", "shadow"),
+		WithHostsMap(map[string]net.IP{"shadow.example.invalid": net.ParseIP("127.0.0.1")}),
+	)
+	send(t, i, "backend")
+
+	select {
+	case <-mirrored:
+	case <-time.After(5 * time.Second):
+		t.Error("mirror request never reached the origin through the hosts map")
+	}
+}
+
+func TestHostsMap(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer origin.Close()
+
+	u, _ := url.Parse(origin.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	var cases = []struct {
+		name   string
+		cfg    BackendConfig
+		hosts  map[string]net.IP
+		status int
+	}{
+		{"mapped", BackendConfig{URL: "http://api.example.invalid:" + port}, map[string]net.IP{
+			"api.example.invalid": net.ParseIP("127.0.0.1"),
+		}, http.StatusTeapot},
+		{"unmapped", BackendConfig{URL: "http://api.example.invalid:" + port}, nil, http.StatusBadGateway},
+		// 192.0.2.1 is reserved for documentation, so the pinned ip winning the race is the only way
+		// this request would succeed
+		{"pinned", BackendConfig{URL: "http://api.example.invalid:" + port, PinIP: net.ParseIP("127.0.0.1")}, map[string]net.IP{
+			"api.example.invalid": net.ParseIP("192.0.2.1"),
+		}, http.StatusTeapot},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			h, err := c.cfg.Handler()
+			if err != nil {
+				st.Fatal(err)
+			}
+			h.(*httputil.ReverseProxy).ErrorLog = log.New(ioutil.Discard, "", 0)
+
+			r := httptest.NewRequest("GET", "http://localhost:1337/", nil)
+			w := serve(st, proxyWat, r, WithBackend("backend", h), WithHostsMap(c.hosts))
+			if w.Code != c.status {
+				st.Errorf("expected status %d, got %d", c.status, w.Code)
+			}
+		})
+	}
+}
+
+func TestBackendConfigLatency(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer origin.Close()
+
+	var samples int32
+	h, err := BackendConfig{URL: origin.URL, LatencyFunc: func() time.Duration {
+		atomic.AddInt32(&samples, 1)
+		return 50 * time.Millisecond
+	}}.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every subrequest samples its own delay
+	for n := 0; n < 2; n++ {
+		var start = time.Now()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		if w.Code != http.StatusTeapot {
+			t.Errorf("expected status %d, got %d", http.StatusTeapot, w.Code)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("expected the subrequest to be delayed, took %s", elapsed)
+		}
+	}
+	if n := atomic.LoadInt32(&samples); n != 2 {
+		t.Errorf("expected 2 latency samples, got %d", n)
+	}
+
+	// Canceling the subrequest cuts the delay short
+	h, _ = BackendConfig{URL: origin.URL, LatencyFunc: ConstantLatency(time.Hour)}.Handler()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil).WithContext(ctx))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status %d for a canceled subrequest, got %d", http.StatusBadGateway, w.Code)
+	}
+}
+
+func TestUniformLatency(t *testing.T) {
+	var fn = UniformLatency(10*time.Millisecond, 20*time.Millisecond)
+	for n := 0; n < 100; n++ {
+		if d := fn(); d < 10*time.Millisecond || d >= 20*time.Millisecond {
+			t.Fatalf("expected a latency in [10ms, 20ms), got %s", d)
+		}
+	}
+}
+
+func TestBackendConfigTruncate(t *testing.T) {
+	var body = strings.Repeat("x", 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer origin.Close()
+
+	var cases = []struct {
+		name   string
+		after  int64
+		status int32
+	}{
+		{"truncated", 10, XqdError},
+		{"shorter than limit", 1000, XqdStatusOK},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			i := newTestInstance(st, WithBackendConfig("backend", BackendConfig{URL: origin.URL, TruncateAfter: c.after}))
+
+			_, bhid := send(st, i, "backend")
+
+			// A truncated body fails to read instead of ending early
+			var status int32
+			var read uint32
+			for {
+				status = i.xqd_body_read(int32(bhid), 1024, 64, 208)
+				if status != XqdStatusOK || i.memory.Uint32(208) == 0 {
+					break
+				}
+				read += i.memory.Uint32(208)
+			}
+
+			if status != c.status {
+				st.Errorf("body_read: expected status %d, got %d", c.status, status)
+			}
+			if c.status == XqdStatusOK && read != uint32(len(body)) {
+				st.Errorf("body_read: expected %d bytes, got %d", len(body), read)
+			}
+		})
+	}
+}
+
+func TestBackendConfigTruncateStreaming(t *testing.T) {
+	// The origin only finishes once the first part of its body has been read, so this only passes
+	// if the truncated body is streamed rather than buffered
+	var release = make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(", then the rest"))
+	}))
+	defer origin.Close()
+
+	i := newTestInstance(t, WithBackendConfig("backend", BackendConfig{URL: origin.URL, TruncateAfter: 10}))
+	var bhid uint32
+
+	var read = make(chan string, 1)
+	go func() {
+		_, bhid = send(t, i, "backend")
+		i.xqd_body_read(int32(bhid), 1024, int32(len("first")), 208)
+		var got = make([]byte, i.memory.Uint32(208))
+		i.memory.ReadAt(got, 1024)
+		read <- string(got)
+	}()
+
+	select {
+	case got := <-read:
+		if got != "first" {
+			t.Errorf("expected to read %q first, got %q", "first", got)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("timed out waiting for the start of the body")
+	}
+	close(release)
+
+	// The rest goes over the limit, so it's cut off after 10 bytes in all
+	if s := i.xqd_body_read(int32(bhid), 1024, 5, 208); s != XqdStatusOK || i.memory.Uint32(208) != 5 {
+		t.Fatalf("expected to read up to the limit, got status %d with %d bytes", s, i.memory.Uint32(208))
+	}
+	if s := i.xqd_body_read(int32(bhid), 1024, 64, 208); s != XqdError {
+		t.Errorf("expected reading past the limit to fail, got status %d", s)
+	}
+}
+
+func TestBackendConfigHeaderFuncs(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-Origin-Token", "hunter2")
+		w.Header().Set("X-Origin", "yes")
+	}))
+	defer origin.Close()
+
+	var loop string
+	var config = BackendConfig{
+		URL: origin.URL,
+		RequestHeaderFunc: func(h http.Header) {
+			loop = h.Get("cdn-loop")
+			h.Set("Authorization", "Bearer hunter2")
+		},
+		ResponseHeaderFunc: func(h http.Header) {
+			h.Del("X-Origin-Token")
+		},
+	}
+
+	w := serve(t, proxyWat, httptest.NewRequest("GET", "http://localhost:1337/", nil), WithBackendConfig("backend", config))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if loop != "fastlike" {
+		t.Errorf("expected the request hook to run after cdn-loop is added, got %q", loop)
+	}
+	if w.Header().Get("X-Origin") != "yes" {
+		t.Error("expected origin headers to reach the guest")
+	}
+	if v := w.Header().Get("X-Origin-Token"); v != "" {
+		t.Errorf("expected the response hook to remove X-Origin-Token, got %q", v)
+	}
+}
+
+func TestBackendConfigHTTP2(t *testing.T) {
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("origin-proto", r.Proto)
+	})
+
+	tlsOrigin := httptest.NewUnstartedServer(handler)
+	tlsOrigin.EnableHTTP2 = true
+	tlsOrigin.StartTLS()
+	defer tlsOrigin.Close()
+
+	var roots = x509.NewCertPool()
+	roots.AddCert(tlsOrigin.Certificate())
+
+	h2cOrigin := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cOrigin.Close()
+
+	var cases = []struct {
+		name    string
+		cfg     BackendConfig
+		proto   string
+		version int32
+	}{
+		{"https", BackendConfig{URL: tlsOrigin.URL, RootCAs: roots, HTTP2: true}, "HTTP/2.0", Http2},
+		{"h2c", BackendConfig{URL: h2cOrigin.URL, HTTP2: true}, "HTTP/2.0", Http2},
+		{"http/1.1", BackendConfig{URL: h2cOrigin.URL}, "HTTP/1.1", Http11},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			i := newTestInstance(st, WithBackendConfig("backend", c.cfg))
+			whid, _ := send(st, i, "backend")
+
+			if w := i.responses.Get(int(whid)); w.Header.Get("origin-proto") != c.proto {
+				st.Errorf("expected the origin to see %s, got %q (status %d)", c.proto, w.Header.Get("origin-proto"), w.StatusCode)
+			}
+
+			if s := i.xqd_resp_version_get(int32(whid), 300); s != XqdStatusOK {
+				st.Fatalf("resp_version_get: expected status %d, got %d", XqdStatusOK, s)
+			}
+			if v := int32(i.memory.Uint32(300)); v != c.version {
+				st.Errorf("expected response version %d, got %d", c.version, v)
+			}
+		})
+	}
+}
+
+func TestSubrequestRecorder(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer origin.Close()
+
+	var roots = x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+
+	var recorded []Subrequest
+	i := newTestInstance(t,
+		WithBackendConfig("secure", BackendConfig{
+			URL:          origin.URL,
+			SNIHostname:  "sni.test",
+			CertHostname: "example.com",
+			RootCAs:      roots,
+		}),
+		WithBackend("local", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})),
+		WithSubrequestRecorder(func(s Subrequest) {
+			recorded = append(recorded, s)
+		}),
+	)
+
+	send(t, i, "secure")
+	send(t, i, "local")
+
+	var expected = []Subrequest{
+		{Backend: "secure", Method: "GET", URL: "http://localhost/secure", StatusCode: http.StatusTeapot, SNI: "sni.test"},
+		{Backend: "local", Method: "GET", URL: "http://localhost/local", StatusCode: http.StatusNoContent},
+	}
+	if len(recorded) != len(expected) {
+		t.Fatalf("expected %d recorded subrequests, got %+v", len(expected), recorded)
+	}
+	for j := range expected {
+		if recorded[j] != expected[j] {
+			t.Errorf("expected subrequest %+v, got %+v", expected[j], recorded[j])
+		}
+	}
+}
+
+// roundTripperFunc adapts a function to an http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+func TestBackendTransport(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-path", r.URL.Path)
+		w.Write([]byte("from origin"))
+	}))
+	defer origin.Close()
+
+	u, _ := url.Parse(origin.URL)
+
+	// Send everything to the test origin, whatever host the guest asked for
+	var transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		r = r.Clone(r.Context())
+		r.URL.Host = u.Host
+		return http.DefaultTransport.RoundTrip(r)
+	})
+
+	var failing = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+
+	i := newTestInstance(t,
+		WithBackendTransport("origin", transport),
+		WithBackendTransport("failing", failing),
+	)
+
+	wh, bh := send(t, i, "origin")
+	var w, b = i.responses.Get(int(wh)), i.bodies.Get(int(bh))
+	if w.StatusCode != http.StatusOK || w.Header.Get("x-path") != "/origin" {
+		t.Errorf("expected a 200 for /origin, got %d for %q", w.StatusCode, w.Header.Get("x-path"))
+	}
+	if b.Size() != int64(len("from origin")) {
+		t.Errorf("expected body length %d, got %d", len("from origin"), b.Size())
+	}
+	if body, _ := ioutil.ReadAll(b); string(body) != "from origin" {
+		t.Errorf("expected body %q, got %q", "from origin", body)
+	}
+
+	wh, _ = send(t, i, "failing")
+	if code := i.responses.Get(int(wh)).StatusCode; code != http.StatusBadGateway {
+		t.Errorf("expected a failing transport to respond %d, got %d", http.StatusBadGateway, code)
+	}
+}
+
+func TestDefaultBackendTransport(t *testing.T) {
+	var seen []string
+	var transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		seen = append(seen, r.URL.Path)
+		var w = httptest.NewRecorder()
+		w.WriteHeader(http.StatusTeapot)
+		return w.Result(), nil
+	})
+
+	i := newTestInstance(t,
+		WithBackend("named", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		})),
+		WithDefaultBackend(func(_ string) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusGone)
+			})
+		}),
+		WithDefaultBackendTransport(func(name string) http.RoundTripper {
+			if name == "unhandled" {
+				return nil
+			}
+			return transport
+		}),
+	)
+
+	var cases = []struct {
+		backend string
+		status  int
+	}{
+		{"named", http.StatusAccepted},
+		{"unregistered", http.StatusTeapot},
+		{"unhandled", http.StatusGone},
+	}
+
+	for _, c := range cases {
+		wh, _ := send(t, i, c.backend)
+		if code := i.responses.Get(int(wh)).StatusCode; code != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.backend, c.status, code)
+		}
+	}
+
+	if len(seen) != 1 || seen[0] != "/unregistered" {
+		t.Errorf("expected only the unregistered backend to use the default transport, got %q", seen)
+	}
+}
@@ -0,0 +1,208 @@
+package fastlike
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets subrequests through to the origin
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen fails subrequests immediately, without reaching the origin
+	BreakerOpen
+
+	// BreakerHalfOpen lets a single probe subrequest through to decide whether to close again
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// CircuitBreaker stops sending subrequests to a failing origin. After Failures consecutive failed
+// subrequests within Window, the breaker opens and subrequests fail fast with a 503. Once Cooldown
+// has passed, the next subrequest is let through as a probe: if it succeeds the breaker closes,
+// otherwise it opens for another Cooldown.
+// A subrequest fails if the origin responds with a 5xx status, which includes the 502 sent when the
+// origin can't be reached.
+// A CircuitBreaker must not be shared between backends, and must not be copied after first use.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failures that opens the breaker. Defaults to 5.
+	Failures int
+
+	// Window, if set, is the period the consecutive failures must happen within. Failures older
+	// than that are forgotten.
+	Window time.Duration
+
+	// Cooldown is how long the breaker stays open before probing the origin. Defaults to 30
+	// seconds.
+	Cooldown time.Duration
+
+	// Clock is used to measure Window and Cooldown. Defaults to the system clock. The breaker is
+	// shared by every instance using the backend, so it doesn't follow WithClock.
+	Clock Clock
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	first    time.Time
+	opened   time.Time
+	probing  bool
+}
+
+// State returns the current state of the breaker
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	// An open breaker whose cooldown is over is waiting for its probe
+	if cb.state == BreakerOpen && !cb.now().Before(cb.opened.Add(cb.cooldown())) {
+		return BreakerHalfOpen
+	}
+	return cb.state
+}
+
+func (cb *CircuitBreaker) now() time.Time {
+	if cb.Clock == nil {
+		return realClock{}.Now()
+	}
+	return cb.Clock.Now()
+}
+
+func (cb *CircuitBreaker) cooldown() time.Duration {
+	if cb.Cooldown <= 0 {
+		return 30 * time.Second
+	}
+	return cb.Cooldown
+}
+
+func (cb *CircuitBreaker) threshold() int {
+	if cb.Failures <= 0 {
+		return 5
+	}
+	return cb.Failures
+}
+
+// allow reports whether a subrequest may be sent to the origin
+func (cb *CircuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		if cb.now().Before(cb.opened.Add(cb.cooldown())) {
+			return false
+		}
+		cb.state = BreakerHalfOpen
+		cb.probing = true
+		return true
+	case BreakerHalfOpen:
+		// Only one probe at a time
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	}
+
+	return true
+}
+
+// record updates the breaker with the outcome of a subrequest
+func (cb *CircuitBreaker) record(failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	var now = cb.now()
+
+	if cb.state == BreakerHalfOpen {
+		cb.probing = false
+		if failed {
+			cb.state = BreakerOpen
+			cb.opened = now
+		} else {
+			cb.state = BreakerClosed
+			cb.failures = 0
+		}
+		return
+	}
+
+	if !failed {
+		cb.failures = 0
+		return
+	}
+
+	if cb.failures == 0 || (cb.Window > 0 && now.Sub(cb.first) > cb.Window) {
+		cb.failures = 0
+		cb.first = now
+	}
+
+	cb.failures++
+	if cb.failures >= cb.threshold() {
+		cb.state = BreakerOpen
+		cb.opened = now
+		cb.failures = 0
+	}
+}
+
+// handler returns an http.Handler which sends requests to h while the breaker allows it
+func (cb *CircuitBreaker) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cb.allow() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Circuit breaker is open, the origin was not contacted."))
+			return
+		}
+
+		// A response aborted partway through, like one cut short by TruncateAfter, is a failure.
+		// It still has to be recorded, or a half-open breaker would wait on its probe forever.
+		defer func() {
+			if v := recover(); v != nil {
+				cb.record(true)
+				panic(v)
+			}
+		}()
+
+		var sw = &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		cb.record(sw.code >= 500)
+	})
+}
+
+// statusWriter is an http.ResponseWriter that records the status code written to it
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush flushes the underlying http.ResponseWriter, if it can be flushed, so that streamed
+// responses aren't held up by the breaker
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
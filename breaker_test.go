@@ -0,0 +1,137 @@
+package fastlike
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var healthy = false
+	var hits int
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if !healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer origin.Close()
+
+	var clock = NewFakeClock(time.Unix(0, 0))
+	var cb = &CircuitBreaker{Failures: 2, Window: time.Minute, Cooldown: 10 * time.Second, Clock: clock}
+	h, err := BackendConfig{URL: origin.URL, CircuitBreaker: cb}.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		return w.Code
+	}
+
+	// Failures outside of the window don't add up
+	send()
+	clock.Advance(2 * time.Minute)
+	send()
+	if s := cb.State(); s != BreakerClosed {
+		t.Fatalf("expected breaker to be %s, got %s", BreakerClosed, s)
+	}
+
+	send()
+	if s := cb.State(); s != BreakerOpen {
+		t.Fatalf("expected breaker to be %s, got %s", BreakerOpen, s)
+	}
+
+	// An open breaker fails fast
+	hits = 0
+	if code := send(); code != http.StatusServiceUnavailable || hits != 0 {
+		t.Errorf("expected an open breaker to fail fast with 503, got %d after %d hits", code, hits)
+	}
+
+	// After the cooldown, a failed probe opens it again
+	clock.Advance(10 * time.Second)
+	if s := cb.State(); s != BreakerHalfOpen {
+		t.Fatalf("expected breaker to be %s, got %s", BreakerHalfOpen, s)
+	}
+	send()
+	if s := cb.State(); s != BreakerOpen || hits != 1 {
+		t.Fatalf("expected a failed probe to reopen the breaker, got %s after %d hits", s, hits)
+	}
+
+	// and a successful one closes it
+	healthy = true
+	clock.Advance(10 * time.Second)
+	if code := send(); code != http.StatusOK {
+		t.Errorf("expected probe to succeed, got %d", code)
+	}
+	if s := cb.State(); s != BreakerClosed {
+		t.Errorf("expected breaker to be %s, got %s", BreakerClosed, s)
+	}
+}
+
+func TestCircuitBreakerTruncated(t *testing.T) {
+	var body = "truncated"
+	var hits int
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(body))
+	}))
+	defer origin.Close()
+
+	var clock = NewFakeClock(time.Unix(0, 0))
+	var cb = &CircuitBreaker{Failures: 1, Cooldown: time.Second, Clock: clock}
+	h, err := BackendConfig{URL: origin.URL, CircuitBreaker: cb, TruncateAfter: 3}.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send goes through roundtrip, which is what turns the aborted response into a failed read
+	send := func() int {
+		res, _ := roundtrip(h, httptest.NewRequest("GET", "http://localhost/", nil))
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	send()
+	if s := cb.State(); s != BreakerOpen {
+		t.Fatalf("expected a truncated response to open the breaker, got %s", s)
+	}
+
+	// A truncated probe reopens the breaker, rather than leaving it waiting on the probe
+	clock.Advance(time.Second)
+	send()
+	if s := cb.State(); s != BreakerOpen {
+		t.Fatalf("expected a truncated probe to reopen the breaker, got %s", s)
+	}
+
+	body, hits = "ok", 0
+	clock.Advance(time.Second)
+	if code := send(); code != http.StatusOK || hits != 1 {
+		t.Errorf("expected the next probe to reach the origin, got %d after %d hits", code, hits)
+	}
+	if s := cb.State(); s != BreakerClosed {
+		t.Errorf("expected breaker to be %s, got %s", BreakerClosed, s)
+	}
+}
+
+func TestCircuitBreakerFlush(t *testing.T) {
+	var cb = &CircuitBreaker{}
+	h := cb.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("expected the breaker to keep the response writer flushable")
+		}
+		w.Write([]byte("partial"))
+		f.Flush()
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	if !w.Flushed {
+		t.Error("expected the flush to reach the underlying response writer")
+	}
+}
@@ -0,0 +1,44 @@
+package fastlike
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// ContextWithClientIP returns a copy of ctx carrying the supplied client IP address. Requests with
+// this context report it to the downstream_client_ip_addr XQD method instead of the address they
+// came from.
+// This is useful for embedders behind a proxy, and for tests that want to exercise guest logic
+// that depends on the client address.
+func ContextWithClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// clientIP returns the client IP address for a downstream request. An address supplied via
+// ContextWithClientIP wins, followed by the first address in the header configured with
+// WithClientIPHeader, followed by the request's RemoteAddr. It returns nil if none of them has a
+// valid address.
+func (i *Instance) clientIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientIPKey{}).(net.IP); ok && ip != nil {
+		return ip
+	}
+
+	if i.clientIPHeader != "" {
+		// Proxies append to X-Forwarded-For and friends, so the client is the first entry
+		var value = strings.SplitN(r.Header.Get(i.clientIPHeader), ",", 2)[0]
+		if ip := net.ParseIP(strings.TrimSpace(value)); ip != nil {
+			return ip
+		}
+	}
+
+	var host, _, err = net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// RemoteAddr has no port, which happens for hand-made requests
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
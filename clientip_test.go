@@ -0,0 +1,76 @@
+package fastlike
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestDownstreamClientIP(t *testing.T) {
+	var cases = []struct {
+		name     string
+		opts     []Option
+		request  func() *http.Request
+		expected net.IP
+	}{
+		{"ipv4", nil, func() *http.Request {
+			r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+			r.RemoteAddr = "192.0.2.1:4242"
+			return r
+		}, net.IP{192, 0, 2, 1}},
+		{"ipv6", nil, func() *http.Request {
+			r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+			r.RemoteAddr = "[2001:db8::1]:4242"
+			return r
+		}, net.ParseIP("2001:db8::1")},
+		{"no port", nil, func() *http.Request {
+			r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+			r.RemoteAddr = "192.0.2.1"
+			return r
+		}, net.IP{192, 0, 2, 1}},
+		{"header ignored", nil, func() *http.Request {
+			r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+			r.RemoteAddr = "192.0.2.1:4242"
+			r.Header.Set("X-Forwarded-For", "198.51.100.7")
+			return r
+		}, net.IP{192, 0, 2, 1}},
+		{"header", []Option{WithClientIPHeader("X-Forwarded-For")}, func() *http.Request {
+			r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+			r.RemoteAddr = "192.0.2.1:4242"
+			r.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.9")
+			return r
+		}, net.IP{198, 51, 100, 7}},
+		{"invalid header", []Option{WithClientIPHeader("X-Forwarded-For")}, func() *http.Request {
+			r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+			r.RemoteAddr = "192.0.2.1:4242"
+			r.Header.Set("X-Forwarded-For", "unknown")
+			return r
+		}, net.IP{192, 0, 2, 1}},
+		{"context", []Option{WithClientIPHeader("X-Forwarded-For")}, func() *http.Request {
+			r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+			r.RemoteAddr = "192.0.2.1:4242"
+			r.Header.Set("X-Forwarded-For", "198.51.100.7")
+			return r.WithContext(ContextWithClientIP(r.Context(), net.ParseIP("2001:db8::2")))
+		}, net.ParseIP("2001:db8::2")},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			i := newTestInstance(st, c.opts...)
+			i.ds_request = c.request()
+
+			if s := i.xqd_req_downstream_client_ip_addr(100, 0); s != XqdStatusOK {
+				st.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+			}
+
+			var n = i.memory.Uint32(0)
+			if int(n) != len(c.expected) {
+				st.Fatalf("expected %d octets, got %d", len(c.expected), n)
+			}
+			if ip := i.memory.Data()[100 : 100+n]; !bytes.Equal(ip, c.expected) {
+				st.Errorf("expected %s, got %s", c.expected, net.IP(ip))
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package fastlike
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	var clock = NewFakeClock(time.Unix(0, 0))
+
+	var soon, later = clock.After(time.Second), clock.After(time.Minute)
+
+	clock.Advance(time.Second)
+	select {
+	case now := <-soon:
+		if !now.Equal(time.Unix(1, 0)) {
+			t.Errorf("expected to fire at %s, got %s", time.Unix(1, 0), now)
+		}
+	default:
+		t.Error("expected the 1s timer to fire")
+	}
+
+	select {
+	case <-later:
+		t.Error("expected the 1m timer to still be pending")
+	default:
+	}
+
+	clock.Advance(time.Minute)
+	select {
+	case <-later:
+	default:
+		t.Error("expected the 1m timer to fire")
+	}
+}
+
+func TestWithClockLatency(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer origin.Close()
+
+	var clock = NewFakeClock(time.Now())
+	var done = make(chan int)
+	go func() {
+		w := serve(t, proxyWat, httptest.NewRequest("GET", "http://localhost:1337/", nil),
+			WithClock(clock),
+			WithBackendConfig("backend", BackendConfig{URL: origin.URL, LatencyFunc: ConstantLatency(time.Hour)}),
+		)
+		done <- w.Code
+	}()
+
+	// An hour of simulated latency passes as soon as the fake clock is advanced past it
+	var deadline = time.After(5 * time.Second)
+	for {
+		select {
+		case code := <-done:
+			if code != http.StatusTeapot {
+				t.Errorf("expected status %d, got %d", http.StatusTeapot, code)
+			}
+			return
+		case <-deadline:
+			t.Fatal("subrequest was never released by the fake clock")
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(time.Hour)
+		}
+	}
+}
@@ -10,6 +10,9 @@ import (
 	"os"
 	"strings"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
 	"fastlike.dev"
 )
 
@@ -17,6 +20,13 @@ func main() {
 	var wasm = flag.String("wasm", "", "wasm program to execute")
 	var bind = flag.String("bind", "localhost:5000", "address to bind to")
 	var verbosity = flag.Int("v", 0, "verbosity level (0, 1, 2)")
+	var useh2c = flag.Bool("h2c", false, "serve HTTP/2 over cleartext (h2c) in addition to HTTP/1.1")
+	var backendh2 = flag.Bool("backend-http2", false, "use HTTP/2 for requests to backends (h2 over https, h2c over http)")
+	var reload = flag.Bool("reload", false, "reload the wasm program and -dictionary files from disk on SIGHUP")
+	var watch = flag.Bool("watch", false, "reload -dictionary files when they change on disk")
+	var geodb = flag.String("geo", "", "MaxMind GeoIP2 or GeoLite2 database (.mmdb) used for geo lookups")
+	var compress = flag.Bool("compress", false, "gzip responses for clients that accept it, unless the wasm program already encoded them")
+	var healthPath = flag.String("health-path", "", "path which responds 200 without running the wasm program, for health checks (ex: /healthz)")
 
 	var backends = make(backendFlags)
 	flag.Var(&backends, "backend", "<name=address> specifying backends. Use an empty name to specify a catch-all backend (ex: -backend localhost:2000)")
@@ -43,22 +53,58 @@ func main() {
 	var opts = []fastlike.Option{}
 
 	for name, backend := range backends {
+		var proxy = backend.proxy
+		if *backendh2 {
+			h, err := fastlike.BackendConfig{URL: backend.address, HTTP2: true}.Handler()
+			if err != nil {
+				fmt.Fprintf(flag.CommandLine.Output(), "invalid backend %s: %s\n", backend.address, err.Error())
+				os.Exit(1)
+			}
+			proxy = h
+		}
+
 		if name == "" {
 			opts = append(opts, fastlike.WithDefaultBackend(func(_ string) http.Handler {
-				return backend.proxy
+				return proxy
 			}))
 		} else {
-			opts = append(opts, fastlike.WithBackend(name, backend.proxy))
+			opts = append(opts, fastlike.WithBackend(name, proxy))
 		}
 	}
 
 	for name, dictionary := range dictionaries {
-		opts = append(opts, fastlike.WithDictionary(name, dictionary.fn))
+		opts = append(opts, fastlike.WithDictionaryFile(name, dictionary.filename))
+	}
+
+	if *watch {
+		opts = append(opts, fastlike.WithWatchConfigFiles())
+	}
+
+	if *compress {
+		opts = append(opts, fastlike.WithDownstreamCompression(true))
+	}
+
+	if *geodb != "" {
+		opts = append(opts, fastlike.WithGeoDatabase(*geodb))
 	}
 
 	opts = append(opts, fastlike.WithVerbosity(*verbosity))
 
-	fl := fastlike.New(*wasm, opts...)
+	var f = fastlike.New(*wasm, opts...)
+	if *reload {
+		f.EnableReloadOnSIGHUP()
+	}
+
+	var fl http.Handler = f
+
+	if *healthPath != "" {
+		fl = healthHandler(*healthPath, fl)
+	}
+
+	// h2c requests never have TLS info, so they're always treated as insecure by the guest
+	if *useh2c {
+		fl = h2c.NewHandler(fl, &http2.Server{})
+	}
 
 	fmt.Printf("Listening on %s\n", *bind)
 	if err := http.ListenAndServe(*bind, fl); err != nil {
@@ -66,6 +112,20 @@ func main() {
 	}
 }
 
+// healthHandler returns an http.Handler which responds 200 to requests for exactly path, and passes
+// everything else on to h
+func healthHandler(path string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK\n"))
+	})
+}
+
 type backend struct {
 	address string
 	proxy   http.Handler
@@ -111,7 +171,6 @@ func (f *backendFlags) Set(v string) error {
 type dictionary struct {
 	name     string
 	filename string
-	fn       fastlike.LookupFunc
 }
 type dictionaryFlags map[string]dictionary
 
@@ -142,12 +201,8 @@ func (f *dictionaryFlags) Set(v string) error {
 		return fmt.Errorf("error parsing dictionary file %s, got %s", filename, err.Error())
 	}
 
-	(*f)[name] = dictionary{name: name, filename: filename, fn: func(key string) string {
-		if v, ok := content[key]; !ok {
-			return ""
-		} else {
-			return v
-		}
-	}}
+	// the contents are only checked here, so that errors are reported as flag errors. The
+	// dictionary itself reads the file again, and keeps reading it when -watch is set.
+	(*f)[name] = dictionary{name: name, filename: filename}
 	return nil
 }
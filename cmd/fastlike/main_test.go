@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	var delegated bool
+	h := healthHandler("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delegated = true
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	var cases = []struct {
+		path      string
+		status    int
+		delegated bool
+	}{
+		{"/healthz", http.StatusOK, false},
+		{"/healthz/", http.StatusTeapot, true},
+		{"/", http.StatusTeapot, true},
+	}
+
+	for _, c := range cases {
+		delegated = false
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:5000"+c.path, nil))
+
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.path, c.status, w.Code)
+		}
+		if delegated != c.delegated {
+			t.Errorf("%s: expected delegated=%t, got %t", c.path, c.delegated, delegated)
+		}
+	}
+}
@@ -13,6 +13,7 @@ const (
 	XqdErrHttpParse       int32 = 7
 	XqdErrHttpUserInvalid int32 = 8
 	XqdErrHttpIncomplete  int32 = 9
+	XqdErrNone            int32 = 10
 )
 
 // HandleInvalid is returned to guests when they attempt to obtain a handle that doesn't exist. For
@@ -29,3 +30,10 @@ const (
 	Http2  int32 = 3
 	Http3  int32 = 4
 )
+
+// Constants used to indicate which end of a body to write to.
+// See BodyWriteEnd in https://docs.rs/fastly-shared for more.
+const (
+	BodyWriteEndBack  int32 = 0
+	BodyWriteEndFront int32 = 1
+)
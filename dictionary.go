@@ -1,8 +1,28 @@
 package fastlike
 
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
 type LookupFunc func(key string) string
 
-func (i *Instance) addDictionary(name string, fn LookupFunc) {
+// DictionaryLookupFunc looks up a key in a dictionary, reporting whether it's present. Unlike
+// LookupFunc, it can tell a missing key apart from a key with an empty value.
+type DictionaryLookupFunc func(key string) (string, bool)
+
+// lookupOK adapts a LookupFunc, which has no way to report missing keys, by treating empty values
+// as missing
+func lookupOK(fn LookupFunc) DictionaryLookupFunc {
+	return func(key string) (string, bool) {
+		var v = fn(key)
+		return v, v != ""
+	}
+}
+
+func (i *Instance) addDictionary(name string, fn DictionaryLookupFunc) {
 	if i.dictionaries == nil {
 		i.dictionaries = []dictionary{}
 	}
@@ -20,8 +40,8 @@ func (i *Instance) getDictionaryHandle(name string) int {
 	return HandleInvalid
 }
 
-func (i *Instance) getDictionary(handle int) LookupFunc {
-	if handle > len(i.dictionaries)-1 {
+func (i *Instance) getDictionary(handle int) DictionaryLookupFunc {
+	if handle < 0 || handle > len(i.dictionaries)-1 {
 		return nil
 	}
 
@@ -30,5 +50,47 @@ func (i *Instance) getDictionary(handle int) LookupFunc {
 
 type dictionary struct {
 	name string
-	get  LookupFunc
+	get  DictionaryLookupFunc
+}
+
+// fileDictionary is a dictionary backed by a JSON file containing only string values. The file can
+// be loaded again while requests are using it, which swaps out the whole map at once.
+type fileDictionary struct {
+	filename string
+
+	mu      sync.RWMutex
+	content map[string]string
+}
+
+func newFileDictionary(filename string) (*fileDictionary, error) {
+	var d = &fileDictionary{filename: filename}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load reads the file from disk again. If it can't be read or parsed, the old contents are kept.
+func (d *fileDictionary) load() error {
+	data, err := ioutil.ReadFile(d.filename)
+	if err != nil {
+		return err
+	}
+
+	var content = map[string]string{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return fmt.Errorf("error parsing dictionary file %s, got %s", d.filename, err.Error())
+	}
+
+	d.mu.Lock()
+	d.content = content
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *fileDictionary) lookup(key string) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	v, ok := d.content[key]
+	return v, ok
 }
@@ -33,6 +33,13 @@
 // an http.Request and returns an (http.Response, error) pair. The default implementation of this
 // function is to return a 502 Bad Gateway.
 //
+// COOKIES
+//
+// The ABI has no methods for cookies. Guests read the Cookie header with the regular header methods
+// and write Set-Cookie response headers the same way, and fastlike passes both through untouched.
+// A guest that fails to link because it imports a cookie method was built against an ABI newer
+// than the one implemented here.
+//
 // [abi.rs]: https://docs.rs/crate/fastly/0.3.2/source/src/abi.rs
 // [lib.rs]: https://docs.rs/crate/fastly-shared/0.3.2/source/src/lib.rs
 
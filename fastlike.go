@@ -1,11 +1,18 @@
 package fastlike
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
 	"runtime"
 	"sync"
+	"syscall"
+
+	"github.com/bytecodealliance/wasmtime-go"
 )
 
 // Fastlike is the entrypoint to the package, used to construct new instances ready to serve
@@ -13,21 +20,66 @@ import (
 // startup costs across multiple requests. In the case of a spike of incoming requests, new
 // instances will be constructed on-demand and thrown away when the request is finished to avoid an
 // ever-increasing memory cost.
+//
+// The pool can be tuned with the WithInstancePoolSize and WithInstanceWarmup options passed to New.
+// Once an explicit pool size is set, no more than that many instances are ever live for requests
+// served through Fastlike.ServeHTTP, and requests wait for an instance to be returned once the pool
+// is exhausted. WithInstanceReuseDisabled turns pooling off entirely, to rule out state leaking
+// between requests.
+//
+// The wasm program can be reloaded from disk with Reload, or on SIGHUP with EnableReloadOnSIGHUP.
+// Requests already running finish on the old program, and its instances are dropped instead of
+// returning to the pool.
 type Fastlike struct {
+	wasmfile string
+	opts     []Option
+	warmup   int
+
+	// noReuse drops every instance after it has served a request
+	noReuse bool
+
+	// dictionaries are the file dictionaries shared by every instance, loaded again by
+	// ReloadDictionaries
+	dictionaries []*fileDictionary
+
+	// metrics receives the pool metrics. Like the pool settings, it comes from the instance options.
+	metrics Metrics
+
 	instances chan *Instance
 
+	// slots holds a token for every live instance when the pool is bounded. When nil, an exhausted
+	// pool grows on demand instead.
+	slots chan struct{}
+
+	// mu guards instancefn and generation, which change on reload
+	mu sync.RWMutex
+
 	// instancefn is called when a new instance must be created from scratch
 	instancefn func(opts ...Option) *Instance
+
+	// generation is incremented on every reload. Instances are stamped with the generation they
+	// were created in, so that stale ones can be dropped.
+	generation int
 }
 
 // New returns a new Fastlike ready to create new instances from
 func New(wasmfile string, instanceOpts ...Option) *Fastlike {
-	var f = &Fastlike{}
+	var f = &Fastlike{wasmfile: wasmfile, opts: instanceOpts}
 
 	// read in the file and store the bytes
 	wasmbytes, err := ioutil.ReadFile(wasmfile)
 	check(err)
 
+	f.instancefn = f.loader(wasmbytes)
+
+	// Pool settings are carried on the instance options, so build the first instance up front to
+	// read them. It goes into the pool and counts towards the warmup.
+	var first = f.newInstance()
+	f.warmup = first.warmup
+	f.metrics = first.metrics
+	f.dictionaries = first.fileDictionaries
+	f.incr("instances_created")
+
 	var size = runtime.NumCPU()
 
 	if size > 16 {
@@ -36,30 +88,207 @@ func New(wasmfile string, instanceOpts ...Option) *Fastlike {
 		size = 0
 	}
 
+	if first.poolSize > 0 {
+		size = first.poolSize
+		f.slots = make(chan struct{}, size)
+	}
+
 	f.instances = make(chan *Instance, size)
-	f.instancefn = func(opts ...Option) *Instance {
-		// merge the original options with any supplied options
-		opts = append(instanceOpts, opts...)
-		return NewInstance(wasmbytes, opts...)
+	f.put(first, f.acquire())
+
+	// The first instance hasn't served anything yet, so it stays in the pool either way
+	f.noReuse = first.reuseDisabled
+	if f.noReuse {
+		f.warmup = 0
+	} else if first.warmup > 1 {
+		f.Warmup(first.warmup - 1)
+	}
+
+	// File dictionaries are shared by every instance, so a single watcher covers them all
+	if first.watchConfigFiles && len(first.fileDictionaries) > 0 {
+		if err := watchDictionaries(first.fileDictionaries); err != nil {
+			fmt.Printf("Warning: not watching dictionary files for changes, got %s\n", err.Error())
+		}
 	}
 
 	return f
 }
 
+// loader returns an instancefn creating instances of the supplied wasm program
+func (f *Fastlike) loader(wasmbytes []byte) func(opts ...Option) *Instance {
+	return func(opts ...Option) *Instance {
+		// merge the original options with any supplied options, without sharing the backing
+		// array between concurrent calls
+		var merged = make([]Option, 0, len(f.opts)+len(opts))
+		merged = append(merged, f.opts...)
+		merged = append(merged, opts...)
+		return NewInstance(wasmbytes, merged...)
+	}
+}
+
+// newInstance creates an instance of the current wasm program
+func (f *Fastlike) newInstance(opts ...Option) *Instance {
+	f.mu.RLock()
+	var fn, generation = f.instancefn, f.generation
+	f.mu.RUnlock()
+
+	var i = fn(opts...)
+	i.generation = generation
+	f.incr("instances_created")
+	return i
+}
+
+// stale reports whether i was created from a wasm program that has since been reloaded
+func (f *Fastlike) stale(i *Instance) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return i.generation != f.generation
+}
+
+// Reload reads the wasm program from disk again and uses it for every request from now on.
+// Requests that are already running aren't interrupted, and finish using the old program. Pooled
+// instances of the old program are thrown away, and the pool is warmed up again if
+// WithInstanceWarmup was used. If the new program can't be read or isn't valid wasm, an error is
+// returned and the old program stays in use.
+func (f *Fastlike) Reload() error {
+	wasmbytes, err := ioutil.ReadFile(f.wasmfile)
+	if err != nil {
+		return err
+	}
+
+	if err := wasmtime.ModuleValidate(wasmtime.NewStore(wasmtime.NewEngine()), wasmbytes); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.instancefn = f.loader(wasmbytes)
+	f.generation++
+	f.mu.Unlock()
+
+	// Drain the pool of old instances. Old instances still serving requests are dropped when
+	// they're returned. Each instance has its own store, so the old program is freed once the last
+	// one is gone.
+	for drained := false; !drained; {
+		select {
+		case <-f.instances:
+			f.release()
+		default:
+			drained = true
+		}
+	}
+
+	if f.warmup > 0 {
+		f.Warmup(f.warmup)
+	}
+
+	return nil
+}
+
+// ReloadDictionaries reads every dictionary added with WithDictionaryFile from disk again. The new
+// contents are used right away, including by requests that are already running. A file that can't
+// be read or parsed keeps its old contents, and the first such error is returned once the rest have
+// been reloaded.
+func (f *Fastlike) ReloadDictionaries() error {
+	var first error
+	for _, d := range f.dictionaries {
+		if err := d.load(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// EnableReloadOnSIGHUP calls ReloadDictionaries and Reload whenever the process receives SIGHUP.
+// Errors are printed, and leave the old program or dictionary contents in use.
+func (f *Fastlike) EnableReloadOnSIGHUP() {
+	var ch = make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	go func() {
+		for range ch {
+			if len(f.dictionaries) > 0 {
+				if err := f.ReloadDictionaries(); err != nil {
+					fmt.Printf("Error reloading dictionaries, got %s\n", err.Error())
+				} else {
+					fmt.Printf("Reloaded dictionaries\n")
+				}
+			}
+
+			if err := f.Reload(); err != nil {
+				fmt.Printf("Error reloading %s, got %s\n", f.wasmfile, err.Error())
+				continue
+			}
+			fmt.Printf("Reloaded %s\n", f.wasmfile)
+		}
+	}()
+}
+
 // ServeHTTP implements http.Handler for a Fastlike module. It's a convenience function over
 // `Instantiate()` followed by `.ServeHTTP` on the returned instance.
 func (f *Fastlike) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var i = f.Instantiate()
+	f.serve(w, r)
+}
 
-	i.ServeHTTP(w, r)
+// ErrNoResponse is returned by Handle when the wasm program exits without sending a response
+// downstream.
+var ErrNoResponse = errors.New("wasm program did not send a response downstream")
 
-	select {
-	case f.instances <- i:
-	default:
+// Handle runs the wasm program against the request and returns the response it sent downstream,
+// without going through an HTTP server. The request is served by an instance from the same pool
+// ServeHTTP uses. If the program traps, the error is returned instead of the 500 ServeHTTP would
+// write, and if it finishes without sending a response, Handle returns ErrNoResponse.
+func (f *Fastlike) Handle(r *http.Request) (*http.Response, error) {
+	var w = &captureWriter{ResponseRecorder: httptest.NewRecorder()}
+	if err := f.serve(w, r); err != nil {
+		return nil, err
+	}
+
+	if !w.wrote {
+		return nil, ErrNoResponse
+	}
+
+	var resp = w.Result()
+	resp.Request = r
+	return resp, nil
+}
+
+func (f *Fastlike) serve(w http.ResponseWriter, r *http.Request) error {
+	var i *Instance
+	if f.slots == nil {
+		i = f.Instantiate()
+	} else {
+		i = f.wait()
 	}
+
+	var err = i.serve(w, r)
+
+	f.put(i, true)
+	return err
+}
+
+// captureWriter records the response for Handle, remembering whether anything was sent at all.
+type captureWriter struct {
+	*httptest.ResponseRecorder
+	wrote bool
+}
+
+func (w *captureWriter) WriteHeader(code int) {
+	w.wrote = true
+	w.ResponseRecorder.WriteHeader(code)
 }
 
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseRecorder.Write(p)
+}
+
+// Warmup fills the pool with up to n new instances, so that the first requests don't pay the cost
+// of creating them.
 func (f *Fastlike) Warmup(n int) {
+	if f.noReuse {
+		return
+	}
+
 	if n > cap(f.instances) {
 		fmt.Printf("Warmup count %d is greater than max pool size %d. Clamping to max.\n", n, cap(f.instances))
 		n = cap(f.instances)
@@ -67,18 +296,82 @@ func (f *Fastlike) Warmup(n int) {
 
 	var wg sync.WaitGroup
 	for i := 0; i < n; i++ {
+		if !f.acquire() {
+			break
+		}
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			select {
-			case f.instances <- f.instancefn():
-			default:
-			}
+			f.put(f.newInstance(), true)
 		}()
 	}
 	wg.Wait()
 }
 
+// acquire reserves room for a new live instance in a bounded pool, returning false if the pool is
+// already at capacity. Unbounded pools always have room.
+func (f *Fastlike) acquire() bool {
+	if f.slots == nil {
+		return true
+	}
+
+	select {
+	case f.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// put returns an instance to the pool, dropping it if the pool is full, the instance is stale or
+// was interrupted, or reuse is disabled. owned reports whether the instance holds a slot in a
+// bounded pool, which is released if it's dropped.
+func (f *Fastlike) put(i *Instance, owned bool) {
+	if !f.noReuse && !f.stale(i) && !i.interrupted {
+		select {
+		case f.instances <- i:
+			return
+		default:
+		}
+	}
+
+	if owned {
+		f.release()
+	}
+}
+
+// release gives up the slot of an instance leaving a bounded pool
+func (f *Fastlike) release() {
+	if f.slots != nil {
+		<-f.slots
+	}
+}
+
+// wait returns an instance from a bounded pool, creating one if there's room and otherwise waiting
+// for an instance to be returned.
+func (f *Fastlike) wait() *Instance {
+	for {
+		var i *Instance
+		select {
+		case i = <-f.instances:
+		default:
+			select {
+			case i = <-f.instances:
+			case f.slots <- struct{}{}:
+				return f.newInstance()
+			}
+		}
+
+		// An instance can be taken from the pool just before a reload drains it
+		if !f.stale(i) {
+			f.incr("instances_reused")
+			return i
+		}
+		f.release()
+	}
+}
+
 // Instantiate returns an Instance ready to serve requests. This may come from the instance pool if
 // one is available, but otherwise will be constructed fresh.
 // This *must* be called for each request, as the XQD runtime is designed around a single
@@ -86,12 +379,18 @@ func (f *Fastlike) Warmup(n int) {
 func (f *Fastlike) Instantiate(opts ...Option) *Instance {
 	select {
 	case i := <-f.instances:
+		// Instances handed out here are never returned to the pool, so give up their slot
+		f.release()
+		if f.stale(i) {
+			return f.newInstance(opts...)
+		}
 		for _, opt := range opts {
 			opt(i)
 		}
+		f.incr("instances_reused")
 		return i
 	default:
-		return f.instancefn(opts...)
+		return f.newInstance(opts...)
 	}
 }
 
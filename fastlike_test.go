@@ -0,0 +1,419 @@
+package fastlike
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// helloWat is a guest using the modern ABI which responds to every request with "Hello, world!"
+const helloWat = `
+(module
+  (import "fastly_abi" "init" (func $init (param i64) (result i32)))
+  (import "fastly_http_resp" "new" (func $resp_new (param i32) (result i32)))
+  (import "fastly_http_body" "new" (func $body_new (param i32) (result i32)))
+  (import "fastly_http_body" "write" (func $body_write (param i32 i32 i32 i32 i32) (result i32)))
+  (import "fastly_http_resp" "send_downstream" (func $send_downstream (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 64) "Hello, world!")
+  (func (export "_start")
+    (drop (call $init (i64.const 1)))
+    (drop (call $resp_new (i32.const 0)))
+    (drop (call $body_new (i32.const 4)))
+    (drop (call $body_write (i32.load (i32.const 4)) (i32.const 64) (i32.const 13) (i32.const 0) (i32.const 8)))
+    (drop (call $send_downstream (i32.load (i32.const 0)) (i32.load (i32.const 4)) (i32.const 0)))))
+`
+
+// proxyWat is a guest using the modern ABI which sends the downstream request to the backend named
+// "backend" and sends the response back downstream
+const proxyWat = `
+(module
+  (import "fastly_http_req" "body_downstream_get" (func $body_downstream_get (param i32 i32) (result i32)))
+  (import "fastly_http_req" "send" (func $send (param i32 i32 i32 i32 i32 i32) (result i32)))
+  (import "fastly_http_resp" "send_downstream" (func $send_downstream (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 64) "backend")
+  (func (export "_start")
+    (drop (call $body_downstream_get (i32.const 0) (i32.const 4)))
+    (drop (call $send (i32.load (i32.const 0)) (i32.load (i32.const 4)) (i32.const 64) (i32.const 7) (i32.const 8) (i32.const 12)))
+    (drop (call $send_downstream (i32.load (i32.const 8)) (i32.load (i32.const 12)) (i32.const 0)))))
+`
+
+// wat compiles a module in the wasm text format, failing the test if it's invalid
+func wat(t testing.TB, src string) []byte {
+	t.Helper()
+	wasm, err := wasmtime.Wat2Wasm(src)
+	if err != nil {
+		t.Fatalf("invalid wat: %s", err)
+	}
+	return wasm
+}
+
+// serve runs a single request through a fresh instance of the supplied guest
+func serve(t testing.TB, src string, r *http.Request, opts ...Option) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	NewInstance(wat(t, src), opts...).ServeHTTP(w, r)
+	return w
+}
+
+// newTestInstance returns an Instance whose memory is a plain byte slice, suitable for calling
+// xqd methods directly
+func newTestInstance(t testing.TB, opts ...Option) *Instance {
+	t.Helper()
+	i := NewInstance(wat(t, helloWat), opts...)
+	i.memory = &Memory{ByteMemory(make([]byte, 64*1024))}
+	return i
+}
+
+// newTestFastlike writes the supplied guest to a temporary file and returns a Fastlike for it
+func newTestFastlike(t testing.TB, src string, opts ...Option) *Fastlike {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fastlike")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var file = filepath.Join(dir, "guest.wasm")
+	if err := ioutil.WriteFile(file, wat(t, src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return New(file, opts...)
+}
+
+func TestInstancePool(t *testing.T) {
+	var created int32
+	count := func(_ *Instance) { atomic.AddInt32(&created, 1) }
+
+	f := newTestFastlike(t, helloWat, count, WithInstancePoolSize(2), WithInstanceWarmup(2))
+	if n := atomic.LoadInt32(&created); n != 2 {
+		t.Fatalf("expected 2 instances after warmup, got %d", n)
+	}
+
+	var wg sync.WaitGroup
+	for j := 0; j < 16; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:1337/", nil))
+			if w.Code != http.StatusOK || w.Body.String() != "Hello, world!" {
+				t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&created); n != 2 {
+		t.Errorf("expected the pool to stay at 2 instances, got %d", n)
+	}
+}
+
+func TestInstanceReuseDisabled(t *testing.T) {
+	var created int32
+	count := func(_ *Instance) { atomic.AddInt32(&created, 1) }
+
+	f := newTestFastlike(t, helloWat, count, WithInstanceReuseDisabled(), WithInstanceWarmup(4), WithInstancePoolSize(2))
+	if n := atomic.LoadInt32(&created); n != 1 {
+		t.Fatalf("expected warmup to be skipped, got %d instances", n)
+	}
+
+	for j := 0; j < 3; j++ {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:1337/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+		}
+	}
+
+	if n := atomic.LoadInt32(&created); n != 3 {
+		t.Errorf("expected a fresh instance for each of 3 requests, got %d", n)
+	}
+
+	// Used instances are dropped, and give their slot back
+	if len(f.instances) != 0 || len(f.slots) != 0 {
+		t.Errorf("expected no instances kept around, got %d pooled and %d live", len(f.instances), len(f.slots))
+	}
+}
+
+// BenchmarkInstancePool serves a burst of concurrent requests against a fresh Fastlike, with and
+// without a warmed up pool, and reports the p99 latency of the burst.
+func BenchmarkInstancePool(b *testing.B) {
+	const burst = 16
+
+	var cases = []struct {
+		name string
+		opts []Option
+	}{
+		{"cold", []Option{WithInstancePoolSize(burst), WithInstanceWarmup(1)}},
+		{"warm", []Option{WithInstancePoolSize(burst), WithInstanceWarmup(burst)}},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(sb *testing.B) {
+			var latencies []time.Duration
+			var mu sync.Mutex
+
+			for n := 0; n < sb.N; n++ {
+				sb.StopTimer()
+				f := newTestFastlike(sb, helloWat, c.opts...)
+				sb.StartTimer()
+
+				var wg sync.WaitGroup
+				for j := 0; j < burst; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						var start = time.Now()
+						f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost:1337/", nil))
+						mu.Lock()
+						latencies = append(latencies, time.Since(start))
+						mu.Unlock()
+					}()
+				}
+				wg.Wait()
+			}
+
+			sort.Slice(latencies, func(a, b int) bool { return latencies[a] < latencies[b] })
+			sb.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-µs")
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	var againWat = strings.Replace(helloWat, `"Hello, world!"`, `"Hello, again!"`, 1)
+
+	f := newTestFastlike(t, helloWat, WithInstancePoolSize(4), WithInstanceWarmup(4))
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:1337/", nil))
+		return w
+	}
+
+	// Keep requests running across the reload; each must be served by one program or the other
+	var stop = make(chan struct{})
+	var wg sync.WaitGroup
+	for j := 0; j < 8; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				w := get()
+				if body := w.Body.String(); w.Code != http.StatusOK || (body != "Hello, world!" && body != "Hello, again!") {
+					t.Errorf("unexpected response during reload %d %q", w.Code, body)
+					return
+				}
+			}
+		}()
+	}
+
+	if err := ioutil.WriteFile(f.wasmfile, wat(t, againWat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	for j := 0; j < 8; j++ {
+		if body := get().Body.String(); body != "Hello, again!" {
+			t.Fatalf("expected the reloaded program to respond %q, got %q", "Hello, again!", body)
+		}
+	}
+
+	// A broken program is rejected, leaving the current one in place
+	if err := ioutil.WriteFile(f.wasmfile, []byte("not wasm"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err == nil {
+		t.Error("expected reloading an invalid program to fail")
+	}
+	if body := get().Body.String(); body != "Hello, again!" {
+		t.Errorf("expected the previous program to keep responding, got %q", body)
+	}
+}
+
+func TestReloadInFlight(t *testing.T) {
+	var againWat = strings.Replace(helloWat, `"Hello, world!"`, `"Hello, again!"`, 1)
+
+	f := newTestFastlike(t, helloWat, WithInstancePoolSize(2))
+
+	// Hold on to an instance of the old program across the reload, as a running request would
+	var old = f.wait()
+
+	if err := ioutil.WriteFile(f.wasmfile, wat(t, againWat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	old.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:1337/", nil))
+	if body := w.Body.String(); body != "Hello, world!" {
+		t.Errorf("expected the in-flight instance to finish with the old program, got %q", body)
+	}
+
+	// Returning it drops it rather than pooling the old program
+	f.put(old, true)
+	if n := len(f.instances); n != 0 {
+		t.Errorf("expected the stale instance to be dropped, got %d pooled", n)
+	}
+
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:1337/", nil))
+	if body := w.Body.String(); body != "Hello, again!" {
+		t.Errorf("expected the reloaded program to respond, got %q", body)
+	}
+}
+
+func TestReloadDictionaries(t *testing.T) {
+	var dir = t.TempDir()
+	var colors, sizes = filepath.Join(dir, "colors.json"), filepath.Join(dir, "sizes.json")
+	if err := ioutil.WriteFile(colors, []byte(`{"color": "red"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sizes, []byte(`{"size": "small"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newTestFastlike(t, helloWat, WithDictionaryFile("colors", colors), WithDictionaryFile("sizes", sizes))
+
+	var lookup = func(dictionary, key string) string {
+		i := f.Instantiate()
+		defer f.put(i, true)
+		v, _ := i.getDictionary(i.getDictionaryHandle(dictionary))(key)
+		return v
+	}
+
+	if err := ioutil.WriteFile(colors, []byte(`{"color": "green"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookup("colors", "color"); got != "red" {
+		t.Fatalf("expected the dictionary to keep color red until reloaded, got %q", got)
+	}
+
+	if err := f.ReloadDictionaries(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	if got := lookup("colors", "color"); got != "green" {
+		t.Errorf("expected color green after reloading, got %q", got)
+	}
+
+	// A broken file is reported and keeps its old contents, without holding back the others
+	if err := ioutil.WriteFile(colors, []byte(`{"color": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sizes, []byte(`{"size": "large"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.ReloadDictionaries(); err == nil {
+		t.Error("expected reloading a broken dictionary to fail")
+	}
+	if got := lookup("colors", "color"); got != "green" {
+		t.Errorf("expected the broken dictionary to keep color green, got %q", got)
+	}
+	if got := lookup("sizes", "size"); got != "large" {
+		t.Errorf("expected size large after reloading, got %q", got)
+	}
+}
+
+func TestTimingReporter(t *testing.T) {
+	var mu sync.Mutex
+	var phases = map[string]int{}
+	reporter := func(phase string, d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		if d <= 0 {
+			t.Errorf("expected a positive duration for %q, got %s", phase, d)
+		}
+		phases[phase]++
+	}
+
+	f := newTestFastlike(t, helloWat, WithTimingReporter(reporter))
+	if phases["compile"] != 1 || phases["instantiate"] != 0 {
+		t.Errorf("expected New to compile once without instantiating, got %v", phases)
+	}
+
+	f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost:1337/", nil))
+	if phases["compile"] != 1 || phases["instantiate"] != 1 {
+		t.Errorf("expected the request to reuse the pooled instance and instantiate once, got %v", phases)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	t.Run("response", func(t *testing.T) {
+		f := newTestFastlike(t, helloWat)
+		r := httptest.NewRequest("GET", "http://localhost:1337/", nil)
+		resp, err := f.Handle(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "Hello, world!" {
+			t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+		}
+		if resp.Request != r {
+			t.Error("expected the response to carry the request")
+		}
+	})
+
+	// http.NewRequest leaves Body nil rather than http.NoBody, unlike requests from a server
+	t.Run("nil body", func(t *testing.T) {
+		f := newTestFastlike(t, proxyWat, WithBackend("backend", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("from backend"))
+		})))
+		r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+		resp, err := f.Handle(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "from backend" {
+			t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("no response", func(t *testing.T) {
+		f := newTestFastlike(t, `(module (memory (export "memory") 1) (func (export "_start")))`)
+		_, err := f.Handle(httptest.NewRequest("GET", "http://localhost:1337/", nil))
+		if err != ErrNoResponse {
+			t.Errorf("expected ErrNoResponse, got %v", err)
+		}
+	})
+
+	t.Run("trap", func(t *testing.T) {
+		f := newTestFastlike(t, `(module (memory (export "memory") 1) (func (export "_start") unreachable))`)
+		resp, err := f.Handle(httptest.NewRequest("GET", "http://localhost:1337/", nil))
+		if err == nil {
+			t.Fatalf("expected an error, got a %d response", resp.StatusCode)
+		}
+		if !strings.Contains(err.Error(), "unreachable") {
+			t.Errorf("expected the trap in the error, got %q", err)
+		}
+	})
+}
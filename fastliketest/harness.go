@@ -0,0 +1,180 @@
+// Package fastliketest drives wasm programs through fastlike from Go tests. A Harness registers
+// mock backends and dictionaries, runs requests through the program and records the subrequests
+// and log lines it produced, so tests can assert on them.
+//
+//	h := fastliketest.New("bin/main.wasm").
+//		WithMockBackend("origin", func(r *http.Request) *http.Response {
+//			return fastliketest.Response(http.StatusOK, "Hello, world!")
+//		})
+//
+//	resp, err := h.Do(httptest.NewRequest("GET", "http://localhost/", nil))
+//	...
+//	h.AssertSubrequest(t, "origin", "GET", "http://localhost/")
+package fastliketest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"fastlike.dev"
+)
+
+// Harness runs requests through a wasm program. Backends, dictionaries and options are added with
+// the With methods, which return the Harness so they can be chained, and must all be added before
+// the first call to Do.
+type Harness struct {
+	wasmfile string
+	opts     []fastlike.Option
+
+	once sync.Once
+	fl   *fastlike.Fastlike
+
+	mu          sync.Mutex
+	subrequests []fastlike.Subrequest
+	logs        map[string][]string
+}
+
+// New returns a Harness for the wasm program at wasmfile, configured with opts
+func New(wasmfile string, opts ...fastlike.Option) *Harness {
+	var h = &Harness{wasmfile: wasmfile, logs: map[string][]string{}}
+
+	h.opts = append(h.opts,
+		fastlike.WithSubrequestRecorder(h.recordSubrequest),
+		fastlike.WithLogSink(h.recordLog),
+	)
+	h.opts = append(h.opts, opts...)
+	return h
+}
+
+// WithOptions adds fastlike options to the Harness
+func (h *Harness) WithOptions(opts ...fastlike.Option) *Harness {
+	h.opts = append(h.opts, opts...)
+	return h
+}
+
+// WithMockBackend registers a backend named name whose responses come from fn. Responses without
+// a Body get an empty one. If fn returns nil, the subrequest fails as if the backend couldn't be
+// reached.
+func (h *Harness) WithMockBackend(name string, fn func(*http.Request) *http.Response) *Harness {
+	return h.WithOptions(fastlike.WithBackendTransport(name, mockTransport(fn)))
+}
+
+// WithDictionary registers a dictionary named name with the supplied contents
+func (h *Harness) WithDictionary(name string, values map[string]string) *Harness {
+	return h.WithOptions(fastlike.WithDictionaryLookup(name, func(key string) (string, bool) {
+		v, ok := values[key]
+		return v, ok
+	}))
+}
+
+// Do runs r through the wasm program and returns the response it sent downstream. It fails if the
+// program traps, or finishes without sending a response. The first call builds the underlying
+// Fastlike, which panics if the wasm program can't be loaded.
+func (h *Harness) Do(r *http.Request) (*http.Response, error) {
+	h.once.Do(func() {
+		h.fl = fastlike.New(h.wasmfile, h.opts...)
+	})
+	return h.fl.Handle(r)
+}
+
+// Subrequests returns every subrequest the program sent so far, in the order the backends
+// responded
+func (h *Harness) Subrequests() []fastlike.Subrequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]fastlike.Subrequest{}, h.subrequests...)
+}
+
+// Logs returns every line the program wrote to the named log endpoint so far
+func (h *Harness) Logs(endpoint string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string{}, h.logs[endpoint]...)
+}
+
+// Reset forgets the subrequests and log lines recorded so far
+func (h *Harness) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subrequests = nil
+	h.logs = map[string][]string{}
+}
+
+// AssertSubrequest fails t unless the program sent a subrequest with the method and url to the
+// named backend
+func (h *Harness) AssertSubrequest(t testing.TB, backend, method, url string) {
+	t.Helper()
+	var seen = []string{}
+	for _, s := range h.Subrequests() {
+		if s.Backend == backend && s.Method == method && s.URL == url {
+			return
+		}
+		seen = append(seen, fmt.Sprintf("%s %s %s", s.Backend, s.Method, s.URL))
+	}
+	t.Errorf("expected a subrequest to %s for %s %s, got [%s]", backend, method, url, strings.Join(seen, ", "))
+}
+
+// AssertLogged fails t unless the program wrote line to the named log endpoint
+func (h *Harness) AssertLogged(t testing.TB, endpoint, line string) {
+	t.Helper()
+	var logs = h.Logs(endpoint)
+	for _, l := range logs {
+		if l == line {
+			return
+		}
+	}
+	t.Errorf("expected %q to be logged to %s, got %q", line, endpoint, logs)
+}
+
+func (h *Harness) recordSubrequest(s fastlike.Subrequest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subrequests = append(h.subrequests, s)
+}
+
+func (h *Harness) recordLog(endpoint, message string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.logs[endpoint] = append(h.logs[endpoint], message)
+}
+
+// Response returns a response with the status and body, for mock backends
+func Response(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+// errNoResponse is returned to fastlike when a mock backend doesn't respond
+var errNoResponse = errors.New("mock backend returned no response")
+
+// mockTransport adapts a mock backend function to an http.RoundTripper
+type mockTransport func(*http.Request) *http.Response
+
+func (fn mockTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var res = fn(r)
+	if res == nil {
+		return nil, errNoResponse
+	}
+
+	if res.Body == nil {
+		res.Body = http.NoBody
+	}
+	if res.Header == nil {
+		res.Header = http.Header{}
+	}
+	if res.ProtoMajor == 0 {
+		res.Proto, res.ProtoMajor, res.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	res.Request = r
+	return res, nil
+}
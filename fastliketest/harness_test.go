@@ -0,0 +1,105 @@
+package fastliketest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// greeterWat looks up "greeting" in the "config" dictionary and logs it to "events", then proxies
+// the downstream request to the "origin" backend
+const greeterWat = `
+(module
+  (import "fastly_http_req" "body_downstream_get" (func $body_downstream_get (param i32 i32) (result i32)))
+  (import "fastly_dictionary" "open" (func $dictionary_open (param i32 i32 i32) (result i32)))
+  (import "fastly_dictionary" "get" (func $dictionary_get (param i32 i32 i32 i32 i32 i32) (result i32)))
+  (import "fastly_log" "endpoint_get" (func $endpoint_get (param i32 i32 i32) (result i32)))
+  (import "fastly_log" "write" (func $log_write (param i32 i32 i32 i32) (result i32)))
+  (import "fastly_http_req" "send" (func $send (param i32 i32 i32 i32 i32 i32) (result i32)))
+  (import "fastly_http_resp" "send_downstream" (func $send_downstream (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 64) "origin")
+  (data (i32.const 80) "config")
+  (data (i32.const 96) "greeting")
+  (data (i32.const 112) "events")
+  (func (export "_start")
+    (drop (call $body_downstream_get (i32.const 0) (i32.const 4)))
+    (drop (call $dictionary_open (i32.const 80) (i32.const 6) (i32.const 20)))
+    (drop (call $dictionary_get (i32.load (i32.const 20)) (i32.const 96) (i32.const 8) (i32.const 512) (i32.const 64) (i32.const 24)))
+    (drop (call $endpoint_get (i32.const 112) (i32.const 6) (i32.const 28)))
+    (drop (call $log_write (i32.load (i32.const 28)) (i32.const 512) (i32.load (i32.const 24)) (i32.const 32)))
+    (drop (call $send (i32.load (i32.const 0)) (i32.load (i32.const 4)) (i32.const 64) (i32.const 6) (i32.const 8) (i32.const 12)))
+    (drop (call $send_downstream (i32.load (i32.const 8)) (i32.load (i32.const 12)) (i32.const 0)))))
+`
+
+// program compiles src and writes it to a temporary file, returning its path
+func program(t *testing.T, src string) string {
+	t.Helper()
+	wasm, err := wasmtime.Wat2Wasm(src)
+	if err != nil {
+		t.Fatalf("invalid wat: %s", err)
+	}
+
+	var file = filepath.Join(t.TempDir(), "guest.wasm")
+	if err := ioutil.WriteFile(file, wasm, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestHarness(t *testing.T) {
+	h := New(program(t, greeterWat)).
+		WithDictionary("config", map[string]string{"greeting": "Hello from the dictionary"}).
+		WithMockBackend("origin", func(r *http.Request) *http.Response {
+			var res = Response(http.StatusTeapot, "Hello from the origin")
+			res.Header.Set("X-Path", r.URL.Path)
+			return res
+		})
+
+	resp, err := h.Do(httptest.NewRequest("GET", "http://localhost/teapot", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusTeapot || string(body) != "Hello from the origin" {
+		t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	if p := resp.Header.Get("X-Path"); p != "/teapot" {
+		t.Errorf("expected the origin to see path /teapot, got %q", p)
+	}
+
+	h.AssertSubrequest(t, "origin", "GET", "http://localhost/teapot")
+	h.AssertLogged(t, "events", "Hello from the dictionary")
+
+	h.Reset()
+	if n := len(h.Subrequests()); n != 0 {
+		t.Errorf("expected no subrequests after a reset, got %d", n)
+	}
+}
+
+func TestHarnessUnreachableBackend(t *testing.T) {
+	h := New(program(t, greeterWat)).WithMockBackend("origin", func(r *http.Request) *http.Response {
+		return nil
+	})
+
+	resp, err := h.Do(httptest.NewRequest("GET", "http://localhost/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected a 502 for a backend that didn't respond, got %d", resp.StatusCode)
+	}
+}
+
+func TestHarnessTrap(t *testing.T) {
+	h := New(program(t, `(module (memory (export "memory") 1) (func (export "_start") unreachable))`))
+	if _, err := h.Do(httptest.NewRequest("GET", "http://localhost/", nil)); err == nil {
+		t.Error("expected an error for a program that traps")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
+
+	"github.com/oschwald/maxminddb-golang"
 )
 
 // Geo represents geographic data associated with a particular IP address
@@ -50,9 +52,121 @@ func defaultGeoLookup(ip net.IP) Geo {
 func geoHandler(fn func(ip net.IP) Geo) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		addr := net.ParseIP(r.Header.Get("fastly-xqd-arg1"))
-		geo := fn(addr)
+		geo := fn(addr).withUnknowns()
 
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(geo)
 	})
 }
+
+// withUnknowns fills in "?", which is what Fastly reports for unknown values, in the fields the
+// fastly crate deserializes into enums. Left empty, they'd fail to deserialize in the guest.
+func (g Geo) withUnknowns() Geo {
+	for _, f := range []*string{&g.ConnType, &g.ProxyDescription, &g.ProxyType} {
+		if *f == "" {
+			*f = "?"
+		}
+	}
+	return g
+}
+
+// geoConnections maps MaxMind connection types to Fastly's conn_speed and conn_type
+var geoConnections = map[string][2]string{
+	"Cable/DSL": {"broadband", "wired"},
+	"Cellular":  {"mobile", "mobile"},
+	"Corporate": {"broadband", "wired"},
+	"Dialup":    {"dialup", "dialup"},
+	"Satellite": {"satellite", "satellite"},
+}
+
+// geoDatabase is the subset of maxminddb.Reader used for geo lookups
+type geoDatabase interface {
+	LookupNetwork(ip net.IP, result interface{}) (*net.IPNet, bool, error)
+}
+
+var _ geoDatabase = (*maxminddb.Reader)(nil)
+
+// geoRecord holds the fields of a GeoIP2/GeoLite2 City, Country, or ASN record that have a Fastly
+// equivalent. Fields that aren't present in the database are left empty.
+type geoRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+		MetroCode int     `maxminddb:"metro_code"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Subdivisions []geoSubdivision `maxminddb:"subdivisions"`
+	Traits       struct {
+		ASNumber       int    `maxminddb:"autonomous_system_number"`
+		ASName         string `maxminddb:"autonomous_system_organization"`
+		ConnectionType string `maxminddb:"connection_type"`
+	} `maxminddb:"traits"`
+
+	// GeoLite2-ASN databases put the AS fields at the top level
+	ASNumber int    `maxminddb:"autonomous_system_number"`
+	ASName   string `maxminddb:"autonomous_system_organization"`
+}
+
+type geoSubdivision struct {
+	ISOCode string `maxminddb:"iso_code"`
+}
+
+func (r geoRecord) geo() Geo {
+	var geo = Geo{
+		ASName:      r.Traits.ASName,
+		ASNumber:    r.Traits.ASNumber,
+		City:        r.City.Names["en"],
+		Continent:   r.Continent.Code,
+		CountryCode: r.Country.ISOCode,
+		CountryName: r.Country.Names["en"],
+		Latitude:    r.Location.Latitude,
+		Longitude:   r.Location.Longitude,
+		MetroCode:   r.Location.MetroCode,
+		PostalCode:  r.Postal.Code,
+	}
+
+	if conn, ok := geoConnections[r.Traits.ConnectionType]; ok {
+		geo.ConnSpeed, geo.ConnType = conn[0], conn[1]
+	}
+
+	if r.ASNumber != 0 {
+		geo.ASNumber = r.ASNumber
+		geo.ASName = r.ASName
+	}
+
+	if len(r.Subdivisions) > 0 {
+		geo.Region = r.Subdivisions[0].ISOCode
+	}
+
+	return geo
+}
+
+// databaseGeoLookup returns a geo lookup function backed by db. Addresses that aren't in the
+// database are passed to fallback.
+func databaseGeoLookup(db geoDatabase, fallback func(net.IP) Geo) func(net.IP) Geo {
+	return func(ip net.IP) Geo {
+		if ip == nil {
+			return fallback(ip)
+		}
+
+		var record geoRecord
+		_, ok, err := db.LookupNetwork(ip, &record)
+		if err != nil || !ok {
+			return fallback(ip)
+		}
+
+		return record.geo()
+	}
+}
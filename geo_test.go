@@ -0,0 +1,118 @@
+package fastlike
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeGeoDatabase answers lookups for a fixed set of networks, filling in the record the way
+// maxminddb would decode it
+type fakeGeoDatabase map[string]func(*geoRecord)
+
+func (db fakeGeoDatabase) LookupNetwork(ip net.IP, result interface{}) (*net.IPNet, bool, error) {
+	for cidr, fill := range db {
+		_, network, _ := net.ParseCIDR(cidr)
+		if network.Contains(ip) {
+			fill(result.(*geoRecord))
+			return network, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func TestDatabaseGeoLookup(t *testing.T) {
+	var db = fakeGeoDatabase{
+		"81.2.69.0/24": func(r *geoRecord) {
+			r.City.Names = map[string]string{"en": "London"}
+			r.Continent.Code = "EU"
+			r.Country.ISOCode = "GB"
+			r.Country.Names = map[string]string{"en": "United Kingdom"}
+			r.Location.Latitude = 51.5142
+			r.Location.Longitude = -0.0931
+			r.Subdivisions = []geoSubdivision{{ISOCode: "ENG"}}
+			r.Traits.ASNumber = 20712
+			r.Traits.ASName = "Andrews & Arnold Ltd"
+			r.Traits.ConnectionType = "Cable/DSL"
+		},
+		"2001:218::/32": func(r *geoRecord) {
+			r.Country.ISOCode = "JP"
+			r.ASNumber = 2914
+			r.ASName = "NTT America, Inc."
+		},
+	}
+
+	var lookup = databaseGeoLookup(db, defaultGeoLookup)
+
+	var cases = []struct {
+		ip     string
+		expect func(Geo) bool
+	}{
+		{"81.2.69.142", func(g Geo) bool {
+			return g.City == "London" && g.CountryCode == "GB" && g.Region == "ENG" && g.ASNumber == 20712 && g.Latitude == 51.5142 && g.ConnType == "wired" && g.ConnSpeed == "broadband"
+		}},
+		{"2001:218::1", func(g Geo) bool {
+			return g.CountryCode == "JP" && g.ASNumber == 2914 && g.ASName == "NTT America, Inc."
+		}},
+		{"127.0.0.1", func(g Geo) bool { return g == defaultGeoLookup(nil) }},
+		{"", func(g Geo) bool { return g == defaultGeoLookup(nil) }},
+	}
+
+	for _, c := range cases {
+		if geo := lookup(net.ParseIP(c.ip)); !c.expect(geo) {
+			t.Errorf("unexpected geo for %q: %+v", c.ip, geo)
+		}
+	}
+}
+
+// geoFields are the fields of the Geo struct in the fastly crate, as its serde derive names them.
+// A field with any other name is silently left empty in the guest.
+var geoFields = []string{
+	"area_code", "as_name", "as_number", "city", "conn_speed", "conn_type", "continent",
+	"country_code", "country_code3", "country_name", "latitude", "longitude", "metro_code",
+	"postal_code", "proxy_description", "proxy_type", "region", "utc_offset",
+}
+
+func TestGeoJSON(t *testing.T) {
+	var lookup = func(fn func(net.IP) Geo) []byte {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://geolocation/", nil)
+		r.Header.Set("fastly-xqd-arg1", "127.0.0.1")
+		geoHandler(fn).ServeHTTP(w, r)
+		return w.Body.Bytes()
+	}
+
+	var body = lookup(defaultGeoLookup)
+	golden, err := ioutil.ReadFile("testdata/geo.golden.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, golden) {
+		t.Errorf("geo json doesn't match testdata/geo.golden.json.\nexpected: %s\ngot:      %s", golden, body)
+	}
+
+	var fields = map[string]interface{}{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Fatal(err)
+	}
+	var names = []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != strings.Join(geoFields, ",") {
+		t.Errorf("expected the fastly crate's geo fields\n%q\ngot\n%q", geoFields, names)
+	}
+
+	// Empty values the crate deserializes into enums are reported as unknown instead
+	var empty Geo
+	json.Unmarshal(lookup(func(net.IP) Geo { return Geo{} }), &empty)
+	if empty.ConnType != "?" || empty.ProxyDescription != "?" || empty.ProxyType != "?" {
+		t.Errorf("expected unknown values to be reported as ?, got %+v", empty)
+	}
+}
@@ -2,4 +2,9 @@ module fastlike.dev
 
 go 1.15
 
-require github.com/bytecodealliance/wasmtime-go v0.26.1
+require (
+	github.com/bytecodealliance/wasmtime-go v0.26.1
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/oschwald/maxminddb-golang v1.8.0
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+)
@@ -2,6 +2,8 @@ package fastlike
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -65,7 +67,7 @@ func (rhs *ResponseHandles) Get(id int) *ResponseHandle {
 
 // New creates a new ResponseHandle and returns its handle id and the handle itself.
 func (rhs *ResponseHandles) New() (int, *ResponseHandle) {
-	rh := &ResponseHandle{Response: &http.Response{StatusCode: 200}}
+	rh := &ResponseHandle{Response: &http.Response{StatusCode: 200, Status: statusLine(200)}}
 	rhs.handles = append(rhs.handles, rh)
 	return len(rhs.handles) - 1, rh
 }
@@ -85,8 +87,12 @@ type BodyHandle struct {
 	// reader/writer/closer wrap it
 	buf *bytes.Buffer
 
-	// length is the number of bytes in the body
+	// length is the number of bytes left to read from the body, or -1 if it isn't known up front
 	length int64
+
+	// accumulated is the number of bytes written, prepended, or appended to the body in memory
+	// over its lifetime, which is what the maximum body size limits
+	accumulated int64
 }
 
 // Close implements io.Closer for a BodyHandle
@@ -99,20 +105,121 @@ func (b *BodyHandle) Close() error {
 
 // Read implements io.Reader for a BodyHandle
 func (b *BodyHandle) Read(p []byte) (int, error) {
-	return b.reader.Read(p)
+	n, e := b.reader.Read(p)
+	if b.length >= 0 {
+		b.length -= int64(n)
+		if b.length < 0 {
+			b.length = 0
+		}
+	}
+	return n, e
 }
 
 // Write implements io.Writer for a BodyHandle
 func (b *BodyHandle) Write(p []byte) (int, error) {
 	n, e := b.writer.Write(p)
-	b.length += int64(n)
+	if b.length >= 0 {
+		b.length += int64(n)
+	}
+	if _, ok := b.writer.(*bytes.Buffer); ok {
+		b.accumulated += int64(n)
+	}
 	return n, e
 }
 
-func (b *BodyHandle) Size() int64 {
-	if b.length == 0 {
-		return -1
+// Prepend writes p to the front of the body. Only bodies backed by a buffer can be prepended to.
+func (b *BodyHandle) Prepend(p []byte) (int, error) {
+	if b.buf == nil {
+		return 0, errors.New("cannot prepend to a body that isn't backed by a buffer")
+	}
+
+	var rest = append([]byte{}, b.buf.Bytes()...)
+	b.buf.Reset()
+	b.buf.Write(p)
+	b.buf.Write(rest)
+	b.length += int64(len(p))
+	b.accumulated += int64(len(p))
+	return len(p), nil
+}
+
+// Append adds the contents of src to the end of the body, taking ownership of src: it's closed
+// along with b. Buffered sources are copied over, anything else is read lazily once the rest of b
+// has been read. Writes to b after that go after src, and b can no longer be prepended to.
+// Bodies that are only writable, such as streamed responses, have all of src copied to them.
+// src must not be b.
+func (b *BodyHandle) Append(src *BodyHandle) error {
+	var closer = b.closer
+	b.closer = closerFunc(func() error {
+		if closer != nil {
+			closer.Close()
+		}
+		return src.Close()
+	})
+
+	if b.reader == nil {
+		_, err := io.Copy(b, src)
+		return err
 	}
+
+	if src.buf != nil && b.buf != nil {
+		_, err := b.Write(src.buf.Next(src.buf.Len()))
+		src.length = 0
+		return err
+	}
+
+	b.accumulated += src.appendedSize()
+
+	var tail = new(bytes.Buffer)
+	b.reader = io.MultiReader(b.reader, src, tail)
+	b.writer = tail
+	b.buf = nil
+
+	if b.length >= 0 && src.length >= 0 {
+		b.length += src.length
+	} else {
+		b.length = -1
+	}
+	return nil
+}
+
+// closerFunc adapts a function to io.Closer
+type closerFunc func() error
+
+func (fn closerFunc) Close() error {
+	return fn()
+}
+
+// appendedSize returns the number of bytes the body adds when it's appended to another: what's
+// left to read of it if that's known, or what it accumulated otherwise
+func (b *BodyHandle) appendedSize() int64 {
+	if b.length >= 0 {
+		return b.length
+	}
+	return b.accumulated
+}
+
+// buffer reads what's left of the body into a buffer which backs it from then on, so that it can
+// be read more than once through buf. Bodies already backed by their buffer are left as they are.
+// The length isn't touched, so a body of unknown length stays that way.
+func (b *BodyHandle) buffer() error {
+	if b.buf != nil && b.reader == io.Reader(b.buf) {
+		return nil
+	}
+	if b.reader == nil {
+		return errors.New("cannot buffer a body that can't be read from")
+	}
+
+	var buf = new(bytes.Buffer)
+	if _, err := buf.ReadFrom(b.reader); err != nil {
+		return err
+	}
+
+	b.buf, b.reader, b.writer = buf, buf, buf
+	return nil
+}
+
+// Size returns the number of bytes left to read from the body, or -1 if the length isn't known
+func (b *BodyHandle) Size() int64 {
 	return b.length
 }
 
@@ -139,9 +246,10 @@ func (bhs *BodyHandles) NewBuffer() (int, *BodyHandle) {
 	return len(bhs.handles) - 1, bh
 }
 
-// NewReader creates a BodyHandle whose reader and closer is connected to the supplied ReadCloser
+// NewReader creates a BodyHandle whose reader and closer is connected to the supplied ReadCloser.
+// Its length is unknown until set by the caller.
 func (bhs *BodyHandles) NewReader(rdr io.ReadCloser) (int, *BodyHandle) {
-	bh := &BodyHandle{}
+	bh := &BodyHandle{length: -1}
 	bh.reader = rdr
 	bh.closer = rdr
 	bh.writer = ioutil.Discard
@@ -156,3 +264,47 @@ func (bhs *BodyHandles) NewWriter(w io.Writer) (int, *BodyHandle) {
 	bhs.handles = append(bhs.handles, bh)
 	return len(bhs.handles) - 1, bh
 }
+
+// PendingRequestHandle is a subrequest that was sent asynchronously. done is closed once the
+// response is available.
+type PendingRequestHandle struct {
+	done     chan struct{}
+	response *http.Response
+
+	// cancel aborts the subrequest, if it's still in flight
+	cancel context.CancelFunc
+
+	// A pending request can only be turned into a response once
+	claimed bool
+}
+
+// ready reports whether the response is available without blocking
+func (p *PendingRequestHandle) ready() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// PendingRequestHandles is a slice of PendingRequestHandle with functions to get and create
+type PendingRequestHandles struct {
+	handles []*PendingRequestHandle
+}
+
+// Get returns the PendingRequestHandle identified by id or nil if one does not exist.
+func (phs *PendingRequestHandles) Get(id int) *PendingRequestHandle {
+	if id >= len(phs.handles) {
+		return nil
+	}
+
+	return phs.handles[id]
+}
+
+// New creates a new PendingRequestHandle and returns its handle id and the handle itself.
+func (phs *PendingRequestHandles) New() (int, *PendingRequestHandle) {
+	ph := &PendingRequestHandle{done: make(chan struct{})}
+	phs.handles = append(phs.handles, ph)
+	return len(phs.handles) - 1, ph
+}
@@ -2,6 +2,8 @@ package fastlike
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -9,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/bytecodealliance/wasmtime-go"
 )
@@ -28,6 +31,7 @@ type Instance struct {
 	requests  *RequestHandles
 	responses *ResponseHandles
 	bodies    *BodyHandles
+	pending   *PendingRequestHandles
 
 	// ds_request represents the downstream request, ie the one originated from the user agent
 	ds_request *http.Request
@@ -35,10 +39,34 @@ type Instance struct {
 	// ds_response represents the downstream response, where we're going to write the final output
 	ds_response http.ResponseWriter
 
+	// ds_context is canceled once the downstream request is finished, and is used for any work
+	// that shouldn't outlive it
+	ds_context context.Context
+	ds_cancel  context.CancelFunc
+
 	// backends is used to issue subrequests
 	backends       map[string]http.Handler
 	defaultBackend func(name string) http.Handler
 
+	// transports are backends which send subrequests with an http.RoundTripper
+	transports map[string]http.RoundTripper
+
+	// defaultTransport, if set, sends subrequests to backends that weren't registered, ahead of
+	// defaultBackend
+	defaultTransport func(name string) http.RoundTripper
+
+	// vcrs record or replay the subrequests to a backend, by name
+	vcrs map[string]*vcr
+
+	// recordings, if set, records or replays subrequests to every backend without its own vcr
+	recordings *vcrDir
+
+	// mirrors maps a backend name to the backends that also receive a copy of its subrequests
+	mirrors map[string][]string
+
+	// hosts is a static hostname to ip mapping used when dialing BackendConfig origins
+	hosts map[string]net.IP
+
 	// loggers is used to write log output from the wasm program
 	loggers       []logger
 	defaultLogger func(name string) io.Writer
@@ -46,6 +74,11 @@ type Instance struct {
 	// dictionaries are used to look up string values using string keys
 	dictionaries []dictionary
 
+	// fileDictionaries are the dictionaries backed by files, which are shared between instances
+	// and watched for changes when watchConfigFiles is set
+	fileDictionaries []*fileDictionary
+	watchConfigFiles bool
+
 	// geolookup is a function that accepts a net.IP and returns a Geo
 	geolookup func(net.IP) Geo
 
@@ -54,23 +87,94 @@ type Instance struct {
 	// secureFn is used to determine if a request should be considered secure
 	secureFn func(*http.Request) bool
 
+	// downstreamTLS is used as the TLS state for downstream requests that don't have any
+	downstreamTLS *tls.ConnectionState
+
+	// clientIPHeader names a trusted header to take the downstream client address from
+	clientIPHeader string
+
+	// deterministicAsync makes pending_req_select prefer the first of several finished requests
+	deterministicAsync bool
+
+	// strictABI traps the guest when it calls an unimplemented XQD method
+	strictABI bool
+
+	// abiTracer, if set, is called after every XQD method call made by the guest
+	abiTracer func(ABICall)
+
+	// clock is used for everything time-dependent, so tests can control it
+	clock Clock
+
+	// timingReporter, if set, is told how long each startup phase took
+	timingReporter func(phase string, d time.Duration)
+
+	// subrequestRecorder, if set, is told about every subrequest once it has a response
+	subrequestRecorder func(Subrequest)
+
+	// usage is gathered while serving a request and handed to usageReporter, if set, at the end
+	usage         UsageReport
+	usageReporter func(UsageReport)
+
+	// executionTimeout, if set, is how long the guest may run before it's interrupted
+	executionTimeout time.Duration
+
+	// maxBodySize, if set, is the most bytes a body may buffer, and the most bytes that may be read
+	// from a backend response body
+	maxBodySize int64
+
+	// maxDownstreamBodySize, if set, is the largest request body accepted from the client
+	maxDownstreamBodySize int64
+
+	// compressDownstream gzips responses for clients that accept it
+	compressDownstream bool
+
+	// requestContextFn, if set, supplies the context subrequests derive from instead of the
+	// downstream request's
+	requestContextFn func(*http.Request) context.Context
+
+	// metrics, if set, receives operational metrics
+	metrics Metrics
+
+	// trapHandler writes the response when the wasm program traps
+	trapHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+	// interrupted is set when the guest was interrupted, which makes the instance unfit for reuse
+	interrupted bool
+
+	// poolSize and warmup configure the Fastlike pool this instance is created for
+	poolSize      int
+	warmup        int
+	reuseDisabled bool
+
+	// generation is the Fastlike reload generation the instance was created in
+	generation int
+
 	log    *log.Logger
 	abilog *log.Logger
+
+	// errlog is for problems the host should always hear about, whatever the verbosity
+	errlog *log.Logger
 }
 
 // NewInstance returns an http.Handler that can handle a single request.
 func NewInstance(wasmbytes []byte, opts ...Option) *Instance {
 	var i = new(Instance)
-	i.compile(wasmbytes)
 
 	i.requests = &RequestHandles{}
 	i.bodies = &BodyHandles{}
 	i.responses = &ResponseHandles{}
+	i.pending = &PendingRequestHandles{}
+
+	i.clock = realClock{}
 
 	i.log = log.New(ioutil.Discard, "[fastlike] ", log.Lshortfile)
 	i.abilog = log.New(ioutil.Discard, "[fastlike abi] ", log.Lshortfile)
+	i.errlog = log.New(os.Stderr, "[fastlike] ", log.LstdFlags)
 
 	i.backends = map[string]http.Handler{}
+	i.transports = map[string]http.RoundTripper{}
+	i.vcrs = map[string]*vcr{}
+	i.mirrors = map[string][]string{}
 	i.loggers = []logger{}
 	i.dictionaries = []dictionary{}
 
@@ -88,19 +192,28 @@ func NewInstance(wasmbytes []byte, opts ...Option) *Instance {
 		return UserAgent{}
 	}
 
+	// By default, traps are reported to the client with as much detail as wasmtime gives us
+	i.trapHandler = defaultTrapHandler
+
 	// By default, requests are "secure" if they have TLS info
 	i.secureFn = func(r *http.Request) bool {
-		return r.TLS != nil
+		return tlsState(r) != nil
 	}
 
 	for _, o := range opts {
 		o(i)
 	}
 
+	// Options are applied before compiling, since some of them (like the abi tracer) change how
+	// the XQD methods are linked
+	i.compile(wasmbytes)
+
 	return i
 }
 
 func (i *Instance) reset() {
+	i.flushLoggers()
+
 	// once i is done, drop everything off of it
 	for _, r := range i.requests.handles {
 		if r.Body != nil {
@@ -112,6 +225,18 @@ func (i *Instance) reset() {
 			w.Body.Close()
 		}
 	}
+	// Pending requests the guest abandoned are canceled, and their responses are streamed from
+	// goroutines which only finish once their body is closed. Claimed responses had their body
+	// closed above, so canceling them is only cleanup.
+	for _, p := range i.pending.handles {
+		p.cancel()
+		if !p.claimed {
+			go func(p *PendingRequestHandle) {
+				<-p.done
+				p.response.Body.Close()
+			}(p)
+		}
+	}
 	for _, b := range i.bodies.handles {
 		if b.closer != nil {
 			b.closer.Close()
@@ -125,14 +250,23 @@ func (i *Instance) reset() {
 	*i.requests = RequestHandles{}
 	*i.responses = ResponseHandles{}
 	*i.bodies = BodyHandles{}
+	*i.pending = PendingRequestHandles{}
+
+	if i.ds_cancel != nil {
+		i.ds_cancel()
+	}
 
 	i.ds_response = nil
 	i.ds_request = nil
+	i.ds_context = nil
+	i.ds_cancel = nil
 	i.wasm = nil
 	i.memory = nil
 }
 
 func (i *Instance) setup() {
+	defer i.timing("instantiate", time.Now())
+
 	var err error
 	i.wasm, err = i.wasmctx.linker.Instantiate(i.wasmctx.module)
 	check(err)
@@ -143,11 +277,33 @@ func (i *Instance) setup() {
 	i.memory = &Memory{&wasmMemory{mem: i.wasm.GetExport("memory").Memory()}}
 }
 
+// timing reports the time since start to the timing reporter, if there is one. It measures real
+// elapsed time, even with WithClock.
+func (i *Instance) timing(phase string, start time.Time) {
+	if i.timingReporter != nil {
+		i.timingReporter(phase, time.Since(start))
+	}
+}
+
 // ServeHTTP serves the supplied request and response pair. This is not safe to call twice.
 func (i *Instance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i.serve(w, r)
+}
+
+// serve runs the wasm program against the request and response pair, returning the error the
+// program's entrypoint failed with, if any.
+func (i *Instance) serve(w http.ResponseWriter, r *http.Request) (err error) {
+	var start = i.clock.Now()
+
 	i.setup()
 	defer i.reset()
 
+	i.usage = UsageReport{}
+	defer func() {
+		i.report(start, err)
+		i.measure(start, err)
+	}()
+
 	var loops, ok = r.Header[http.CanonicalHeaderKey("cdn-loop")]
 	if !ok {
 		loops = []string{""}
@@ -167,34 +323,89 @@ func (i *Instance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if i.maxDownstreamBodySize > 0 {
+		// Bodies that say up front they're too large are turned away without running the program.
+		// Anything else fails to read once it goes over.
+		if r.ContentLength > i.maxDownstreamBodySize {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte(fmt.Sprintf("Request body exceeds the limit of %d bytes.\n", i.maxDownstreamBodySize)))
+			return nil
+		}
+		// The limit goes on a copy of the request, so the caller's is left as it was
+		if r.Body != nil {
+			var limited = *r
+			limited.Body = http.MaxBytesReader(w, r.Body, i.maxDownstreamBodySize)
+			r = &limited
+		}
+	}
+
+	if i.downstreamTLS != nil && tlsState(r) == nil {
+		r = r.WithContext(ContextWithTLSState(r.Context(), i.downstreamTLS))
+	}
+
 	i.ds_request = r
 	i.ds_response = w
+	var dsctx = r.Context()
+	if i.requestContextFn != nil {
+		dsctx = i.requestContextFn(r)
+	}
+	i.ds_context, i.ds_cancel = context.WithCancel(dsctx)
+
+	var ctx = r.Context()
+	if i.executionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.executionTimeout)
+		defer cancel()
+	}
 
 	// Start a goroutine which will wait for the context to cancel or wait until the wasm calls are
 	// complete
-	donech := make(chan struct{}, 1)
+	donech := make(chan struct{})
+	interruptedch := make(chan bool, 1)
 	go func(ctx context.Context) {
 		select {
 		case <-ctx.Done():
-			// If the context cancels before we write to the donech it's a timeout/deadline/client
+			// If the context cancels before donech is closed it's a timeout/deadline/client
 			// hung up and we should interrupt the wasm program.
 			i.interrupt.Interrupt()
+			interruptedch <- true
 		case <-donech:
 			// Otherwise, we're good and don't need to do anything else.
+			interruptedch <- false
 		}
-	}(r.Context())
+	}(ctx)
 
 	// The entrypoint for a fastly compute program takes no arguments and returns nothing or an
 	// error. The program itself is responsible for getting a handle on the downstream request
 	// and sending a response downstream.
 	entry := i.wasm.GetExport("_start").Func()
-	_, err := entry.Call()
-	donech <- struct{}{}
-	if err != nil {
+	_, err = entry.Call()
+	close(donech)
+
+	// An interrupt that lands after the program finished would trap whatever runs next, so wait to
+	// find out if there was one
+	i.interrupted = <-interruptedch
+
+	if err != nil && i.interrupted && ctx.Err() == context.DeadlineExceeded && r.Context().Err() == nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Error running wasm program.\n"))
-		w.Write([]byte("Below is a useless blob of wasm backtrace. There may be more in your server logs.\n"))
-		w.Write([]byte(err.Error()))
+		w.Write([]byte(fmt.Sprintf("Wasm program exceeded its execution time limit of %s.\n", i.executionTimeout)))
+		return
+	}
+
+	if err != nil {
+		i.errlog.Printf("wasm program trapped: %s", err.Error())
+		i.trapHandler(w, r, err)
 		return
 	}
+
+	return nil
+}
+
+// defaultTrapHandler responds to a request whose wasm program trapped with a 500 and the trap,
+// including its wasm backtrace
+func defaultTrapHandler(w http.ResponseWriter, r *http.Request, err error) {
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("Error running wasm program.\n"))
+	w.Write([]byte("Below is a useless blob of wasm backtrace. There may be more in your server logs.\n"))
+	w.Write([]byte(err.Error()))
 }
@@ -0,0 +1,131 @@
+package fastlike
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecutionTimeout(t *testing.T) {
+	// spinWat never returns
+	const spinWat = `
+(module
+  (memory (export "memory") 1)
+  (func (export "_start")
+    (loop $spin (br $spin))))
+`
+
+	var done = make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serve(t, spinWat, httptest.NewRequest("GET", "http://localhost:1337/", nil), WithExecutionTimeout(50*time.Millisecond))
+	}()
+
+	select {
+	case w := <-done:
+		if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "execution time limit") {
+			t.Errorf("expected a 500 for exceeding the time limit, got %d %q", w.Code, w.Body.String())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("spinning guest was not interrupted")
+	}
+
+	// Interrupted instances aren't put back in the pool
+	f := newTestFastlike(t, spinWat, WithExecutionTimeout(50*time.Millisecond))
+	i := f.Instantiate()
+	i.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost:1337/", nil))
+	f.put(i, true)
+	if len(f.instances) != 0 {
+		t.Errorf("expected the interrupted instance to be dropped, got %d pooled", len(f.instances))
+	}
+}
+
+func TestMaxDownstreamBodySize(t *testing.T) {
+	// readWat reads the whole downstream body, responding with a 400 if that fails
+	const readWat = `
+(module
+  (import "fastly_http_req" "body_downstream_get" (func $body_downstream_get (param i32 i32) (result i32)))
+  (import "fastly_http_body" "read" (func $body_read (param i32 i32 i32 i32) (result i32)))
+  (import "fastly_http_resp" "new" (func $resp_new (param i32) (result i32)))
+  (import "fastly_http_resp" "status_set" (func $status_set (param i32 i32) (result i32)))
+  (import "fastly_http_body" "new" (func $body_new (param i32) (result i32)))
+  (import "fastly_http_resp" "send_downstream" (func $send_downstream (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "_start") (local $status i32)
+    (drop (call $body_downstream_get (i32.const 0) (i32.const 4)))
+    (block $done
+      (loop $read
+        (local.set $status (call $body_read (i32.load (i32.const 4)) (i32.const 1024) (i32.const 1024) (i32.const 8)))
+        (br_if $done (local.get $status))
+        (br_if $read (i32.load (i32.const 8)))))
+    (drop (call $resp_new (i32.const 12)))
+    (drop (call $status_set (i32.load (i32.const 12)) (select (i32.const 400) (i32.const 200) (local.get $status))))
+    (drop (call $body_new (i32.const 16)))
+    (drop (call $send_downstream (i32.load (i32.const 12)) (i32.load (i32.const 16)) (i32.const 0)))))
+`
+
+	var cases = []struct {
+		name    string
+		body    string
+		chunked bool
+		status  int
+	}{
+		{"under limit", "hello", false, http.StatusOK},
+		{"content-length over limit", strings.Repeat("x", 100), false, http.StatusRequestEntityTooLarge},
+		{"chunked under limit", "hello", true, http.StatusOK},
+		{"chunked over limit", strings.Repeat("x", 100), true, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			r := httptest.NewRequest("POST", "http://localhost:1337/", strings.NewReader(c.body))
+			if c.chunked {
+				r.ContentLength = -1
+			}
+
+			var body = r.Body
+			w := serve(st, readWat, r, WithMaxDownstreamBodySize(10))
+			if w.Code != c.status {
+				st.Errorf("expected status %d, got %d %q", c.status, w.Code, w.Body.String())
+			}
+
+			// The limit is applied to a copy, so the caller's request keeps its own body
+			if r.Body != body {
+				st.Error("expected the caller's request body to be left alone")
+			}
+		})
+	}
+}
+
+func TestTrapHandler(t *testing.T) {
+	const trapWat = `(module (memory (export "memory") 1) (func (export "_start") unreachable))`
+
+	// Traps are logged on the host even without any verbosity
+	var logged bytes.Buffer
+	w := serve(t, trapWat, httptest.NewRequest("GET", "http://localhost:1337/", nil), func(i *Instance) {
+		i.errlog.SetOutput(&logged)
+	})
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "unreachable") {
+		t.Errorf("expected a 500 with the trap, got %d %q", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logged.String(), "wasm program trapped") || !strings.Contains(logged.String(), "unreachable") {
+		t.Errorf("expected the trap to be logged, got %q", logged.String())
+	}
+
+	var trap error
+	handler := func(w http.ResponseWriter, r *http.Request, err error) {
+		trap = err
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Something went wrong, try again later."))
+	}
+
+	w = serve(t, trapWat, httptest.NewRequest("GET", "http://localhost:1337/", nil), WithTrapHandler(handler))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "Something went wrong, try again later." {
+		t.Errorf("expected the trap handler's response, got %d %q", w.Code, w.Body.String())
+	}
+	if trap == nil || !strings.Contains(trap.Error(), "unreachable") {
+		t.Errorf("expected the trap handler to get the trap, got %v", trap)
+	}
+}
@@ -2,6 +2,7 @@ package fastlike
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"os"
 )
@@ -11,7 +12,7 @@ func (i *Instance) addLogger(name string, w io.Writer) {
 		i.loggers = []logger{}
 	}
 
-	i.loggers = append(i.loggers, logger{name, w})
+	i.loggers = append(i.loggers, logger{name: name, w: w, buf: &bytes.Buffer{}})
 }
 
 func (i *Instance) getLoggerHandle(name string) int {
@@ -27,24 +28,72 @@ func (i *Instance) getLoggerHandle(name string) int {
 }
 
 func (i *Instance) getLogger(handle int) io.Writer {
-	if handle > len(i.loggers)-1 {
+	if handle < 0 || handle > len(i.loggers)-1 {
 		return nil
 	}
 
 	return i.loggers[handle]
 }
 
+// flushLoggers writes out any partial lines left over in the log endpoints. It's called once the
+// guest is done, which is the only time an endpoint is closed in this ABI.
+func (i *Instance) flushLoggers() {
+	for _, l := range i.loggers {
+		if err := l.flush(); err != nil {
+			fmt.Printf("got error flushing logger %s, err=%q\n", l.name, err)
+		}
+	}
+}
+
 func defaultLogger(name string) io.Writer {
 	return NewPrefixWriter(name, LineWriter{os.Stdout})
 }
 
+// logger buffers the writes to a log endpoint so that each complete line reaches w in a single
+// Write, no matter how many log_write calls the guest used for it. Lines are passed on with their
+// trailing newline.
 type logger struct {
 	name string
 	w    io.Writer
+
+	// buf holds the partial line written since the last newline
+	buf *bytes.Buffer
 }
 
 func (l logger) Write(data []byte) (int, error) {
-	return l.w.Write(data)
+	l.buf.Write(data)
+
+	for {
+		var j = bytes.IndexByte(l.buf.Bytes(), '\n')
+		if j < 0 {
+			return len(data), nil
+		}
+
+		if _, err := l.w.Write(l.buf.Next(j + 1)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// flush writes out the partial line, if there is one
+func (l logger) flush() error {
+	if l.buf.Len() == 0 {
+		return nil
+	}
+
+	var _, err = l.w.Write(l.buf.Next(l.buf.Len()))
+	return err
+}
+
+// sinkWriter delivers each write to a log sink as a single message
+type sinkWriter struct {
+	name string
+	fn   func(endpoint, message string)
+}
+
+func (s sinkWriter) Write(data []byte) (int, error) {
+	s.fn(s.name, string(bytes.TrimRight(data, "\n")))
+	return len(data), nil
 }
 
 // LineWriter takes a writer and returns a new writer that ensures each Write call ends with
@@ -76,7 +125,7 @@ type PrefixWriter struct {
 
 func (w *PrefixWriter) Write(data []byte) (n int, err error) {
 	l := len(data)
-	msg := make([]byte, len(w.prefix)+2+len(data))
+	msg := make([]byte, 0, len(w.prefix)+2+len(data))
 	msg = append(msg, []byte(w.prefix+": ")...)
 	msg = append(msg, data...)
 
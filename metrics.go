@@ -0,0 +1,51 @@
+package fastlike
+
+import (
+	"time"
+)
+
+// Metrics receives operational metrics from fastlike, so that they can be forwarded to something
+// like Prometheus or statsd. Tags are "key:value" strings. Implementations must be safe to call
+// from multiple goroutines.
+//
+// The metrics are:
+//   - requests, tagged with status (ok, error or timeout): downstream requests handled
+//   - request_duration_seconds, with the same tags: time spent handling each downstream request
+//   - subrequests, tagged with backend: requests the guest sent to backends
+//   - instances_created and instances_reused: instances built from scratch or taken from the pool
+type Metrics interface {
+	IncrCounter(name string, tags ...string)
+	ObserveHistogram(name string, value float64, tags ...string)
+}
+
+// measure records the metrics for the downstream request that started at start, if there's
+// anything to record them to
+func (i *Instance) measure(start time.Time, err error) {
+	if i.metrics == nil {
+		return
+	}
+
+	var status = "status:ok"
+	if err != nil && i.interrupted {
+		status = "status:timeout"
+	} else if err != nil {
+		status = "status:error"
+	}
+
+	i.metrics.IncrCounter("requests", status)
+	i.metrics.ObserveHistogram("request_duration_seconds", i.clock.Now().Sub(start).Seconds(), status)
+}
+
+// incr increments the named counter, if there's anything to record it to
+func (i *Instance) incr(name string, tags ...string) {
+	if i.metrics != nil {
+		i.metrics.IncrCounter(name, tags...)
+	}
+}
+
+// incr increments the named counter, if there's anything to record it to
+func (f *Fastlike) incr(name string, tags ...string) {
+	if f.metrics != nil {
+		f.metrics.IncrCounter(name, tags...)
+	}
+}
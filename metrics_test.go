@@ -0,0 +1,77 @@
+package fastlike
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordedMetrics is a Metrics which counts every counter and histogram by name and tags
+type recordedMetrics struct {
+	mu         sync.Mutex
+	counters   map[string]int
+	histograms map[string]int
+}
+
+func (m *recordedMetrics) IncrCounter(name string, tags ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[strings.Join(append([]string{name}, tags...), ",")]++
+}
+
+func (m *recordedMetrics) ObserveHistogram(name string, value float64, tags ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.histograms[strings.Join(append([]string{name}, tags...), ",")]++
+}
+
+func TestMetrics(t *testing.T) {
+	const trapWat = `(module (memory (export "memory") 1) (func (export "_start") unreachable))`
+
+	var cases = []struct {
+		name       string
+		src        string
+		counters   map[string]int
+		histograms map[string]int
+	}{
+		{"ok", proxyWat, map[string]int{
+			"requests,status:ok":          2,
+			"subrequests,backend:backend": 2,
+			"instances_created":           1,
+			"instances_reused":            2,
+		}, map[string]int{"request_duration_seconds,status:ok": 2}},
+		{"trap", trapWat, map[string]int{
+			"requests,status:error": 2,
+			"instances_created":     1,
+			"instances_reused":      2,
+		}, map[string]int{"request_duration_seconds,status:error": 2}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			var m = &recordedMetrics{counters: map[string]int{}, histograms: map[string]int{}}
+			var backend = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			f := newTestFastlike(st, c.src, WithMetrics(m), WithBackend("backend", backend), WithInstancePoolSize(1))
+
+			for j := 0; j < 2; j++ {
+				f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost:1337/", nil))
+			}
+
+			for k, v := range c.counters {
+				if m.counters[k] != v {
+					st.Errorf("expected counter %s to be %d, got %d", k, v, m.counters[k])
+				}
+			}
+			if len(m.counters) != len(c.counters) {
+				st.Errorf("expected counters %v, got %v", c.counters, m.counters)
+			}
+			for k, v := range c.histograms {
+				if m.histograms[k] != v {
+					st.Errorf("expected histogram %s to be observed %d times, got %d", k, v, m.histograms[k])
+				}
+			}
+		})
+	}
+}
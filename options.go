@@ -1,10 +1,15 @@
 package fastlike
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
 )
 
 // Option is a functional option applied to an Instance at creation time
@@ -18,6 +23,87 @@ func WithBackend(name string, h http.Handler) Option {
 	}
 }
 
+// WithBackendTransport registers a backend identified by `name` whose subrequests are sent with
+// rt.RoundTrip, such as an http.Transport set up with a proxy, client certificates or tracing. The
+// request is passed on as the guest built it, and the guest reads the response body as rt returns
+// it, without buffering it first. If rt returns an error, the guest gets a 502 response.
+//
+// The ABI has no automatic decompression, so the guest sees the body exactly as rt returns it. Note
+// that an http.Transport transparently decompresses gzip responses when it added the
+// Accept-Encoding header itself, which it does for requests that don't set one. Set
+// DisableCompression on the transport to hand the guest the origin's bytes unmodified.
+func WithBackendTransport(name string, rt http.RoundTripper) Option {
+	return func(i *Instance) {
+		i.addBackendTransport(name, rt)
+	}
+}
+
+// WithBackendVCR is an Option that records the subrequests sent to the backend identified by
+// `name` to the file at path, or replays them from it without reaching the backend, depending on
+// mode. Subrequests are matched on their method, URL, body, and Accept, Accept-Encoding and
+// Content-Type headers. The file is JSON, with an "interactions" list of request/response pairs in
+// which response bodies are base64-encoded so they replay byte for byte. It panics if the file
+// can't be read or parsed, except when recording to a file that doesn't exist yet.
+// The backend itself is registered as usual, with WithBackend or one of its variants.
+func WithBackendVCR(name, path string, mode VCRMode) Option {
+	v, err := newVCR(path, mode)
+	check(err)
+
+	return func(i *Instance) {
+		i.vcrs[name] = v
+	}
+}
+
+// WithBackendRecording is an Option that records or replays the subrequests sent to every backend,
+// like WithBackendVCR does for a single one. Each backend gets its own recording in dir, named
+// after the backend with a .json extension, which is created when recording. Subrequests with a
+// body are also matched on the body's SHA-256. When replaying, subrequests that weren't recorded
+// get a 502. Backends with their own WithBackendVCR use that instead.
+// It panics if dir doesn't exist when replaying, or can't be created when recording.
+func WithBackendRecording(dir string, mode VCRMode) Option {
+	d, err := newVCRDir(dir, mode)
+	check(err)
+
+	return func(i *Instance) {
+		i.recordings = d
+	}
+}
+
+// WithBackendConfig registers a backend identified by `name` which proxies subrequests to the
+// origin described by cfg. It panics if the origin URL is invalid.
+func WithBackendConfig(name string, cfg BackendConfig) Option {
+	h, err := cfg.Handler()
+	check(err)
+
+	return func(i *Instance) {
+		i.addBackend(name, h)
+	}
+}
+
+// WithHostsMap is an Option that resolves the supplied hostnames to fixed addresses when connecting
+// to BackendConfig origins, similar to an /etc/hosts file. Hostnames not in the map are resolved
+// normally. A backend with PinIP set always uses that address instead.
+func WithHostsMap(hosts map[string]net.IP) Option {
+	return func(i *Instance) {
+		if i.hosts == nil {
+			i.hosts = map[string]net.IP{}
+		}
+		for name, ip := range hosts {
+			i.hosts[name] = ip
+		}
+	}
+}
+
+// WithMirror is an Option that sends a copy of every subrequest targeting the primary backend to the
+// mirror backend as well. Mirrored requests are sent in the background and their responses are
+// discarded, so they never hold up the primary response. They are canceled when the downstream
+// request finishes.
+func WithMirror(primary, mirror string) Option {
+	return func(i *Instance) {
+		i.addMirror(primary, mirror)
+	}
+}
+
 // WithDefaultBackend is an Option to override the default subrequest backend.
 func WithDefaultBackend(fn func(name string) http.Handler) Option {
 	return func(i *Instance) {
@@ -25,6 +111,16 @@ func WithDefaultBackend(fn func(name string) http.Handler) Option {
 	}
 }
 
+// WithDefaultBackendTransport is an Option that sends subrequests to backends that weren't
+// registered with the http.RoundTripper fn returns for their name, the way WithBackendTransport
+// does for a named backend. A shared transport can be returned for every name so that connections
+// are pooled across them. If fn returns nil, the default backend is used instead.
+func WithDefaultBackendTransport(fn func(name string) http.RoundTripper) Option {
+	return func(i *Instance) {
+		i.defaultTransport = fn
+	}
+}
+
 // WithGeo replaces the default geographic lookup function
 func WithGeo(fn func(net.IP) Geo) Option {
 	return func(i *Instance) {
@@ -32,7 +128,23 @@ func WithGeo(fn func(net.IP) Geo) Option {
 	}
 }
 
-// WithLogger registers a new log endpoint usable from a wasm guest
+// WithGeoDatabase is an Option that answers geo lookups from a MaxMind GeoIP2 or GeoLite2 database
+// file, such as GeoLite2-City.mmdb. Addresses that aren't in the database fall back to the geo
+// lookup that was configured before this option, which is the built-in default unless WithGeo
+// came first. The database is opened once, when the option is created, and panics if it can't be
+// read.
+func WithGeoDatabase(path string) Option {
+	db, err := maxminddb.Open(path)
+	check(err)
+
+	return func(i *Instance) {
+		i.geolookup = databaseGeoLookup(db, i.geolookup)
+	}
+}
+
+// WithLogger registers a new log endpoint usable from a wasm guest. Everything the guest writes to
+// the endpoint named `name` goes to w, one line per Write. A line the guest left unfinished is
+// written when the guest is done.
 func WithLogger(name string, w io.Writer) Option {
 	return func(i *Instance) {
 		i.addLogger(name, w)
@@ -48,23 +160,90 @@ func WithDefaultLogger(fn func(name string) io.Writer) Option {
 	}
 }
 
-// WithDictionary registers a new dictionary with a corresponding lookup function
+// WithLogSink is an Option that delivers every message written to a log endpoint without its own
+// WithLogger to fn, along with the name of the endpoint. Each line the guest writes is one
+// message, with the trailing newline removed, even when it takes several log writes.
+func WithLogSink(fn func(endpoint, message string)) Option {
+	return WithDefaultLogger(func(name string) io.Writer {
+		return sinkWriter{name, fn}
+	})
+}
+
+// WithDictionary registers a new dictionary with a corresponding lookup function. Keys for which
+// fn returns an empty string are reported to the guest as missing; use WithDictionaryLookup to
+// have keys with empty values.
 func WithDictionary(name string, fn LookupFunc) Option {
+	return func(i *Instance) {
+		i.addDictionary(name, lookupOK(fn))
+	}
+}
+
+// WithDictionaryLookup registers a new dictionary with a lookup function that reports whether each
+// key is present, so that missing keys and keys with an empty value look different to the guest
+func WithDictionaryLookup(name string, fn DictionaryLookupFunc) Option {
 	return func(i *Instance) {
 		i.addDictionary(name, fn)
 	}
 }
 
+// WithDictionaryFile registers a new dictionary whose contents are read from a JSON file, which
+// must contain a single object with only string values. Keys with an empty value are present, and
+// only keys missing from the file are reported as missing. It panics if the file can't be read or
+// parsed. Combine it with WithWatchConfigFiles to pick up changes to the file without a restart.
+func WithDictionaryFile(name, filename string) Option {
+	d, err := newFileDictionary(filename)
+	check(err)
+
+	return func(i *Instance) {
+		i.addDictionary(name, d.lookup)
+		i.fileDictionaries = append(i.fileDictionaries, d)
+	}
+}
+
+// WithWatchConfigFiles is an Option that watches the files behind WithDictionaryFile dictionaries
+// and loads them again whenever they change. Bursts of changes are debounced, and each file's
+// contents are swapped out in one go, so a lookup never sees a partially loaded file. A file that
+// fails to load keeps its old contents. If the files can't be watched at all, a warning is printed
+// and the dictionaries keep the contents they started with.
+// It only takes effect when passed to New.
+func WithWatchConfigFiles() Option {
+	return func(i *Instance) {
+		i.watchConfigFiles = true
+	}
+}
+
 // WithSecureFunc is an Option that determines if a request should be considered "secure" or not.
 // If it returns true, the request url has the "https" scheme and the "fastly-ssl" header set when
 // going into the wasm program.
-// The default implementation checks if `req.TLS` is non-nil.
+// The default implementation checks if the request has TLS info, either on `req.TLS` or supplied
+// via ContextWithTLSState or WithDownstreamTLS.
 func WithSecureFunc(fn func(*http.Request) bool) Option {
 	return func(i *Instance) {
 		i.secureFn = fn
 	}
 }
 
+// WithDownstreamTLS is an Option that supplies the TLS connection state for downstream requests
+// that don't carry any, either on `req.TLS` or via ContextWithTLSState. Those requests are then
+// considered secure, and the downstream TLS XQD methods report the supplied state.
+// This is mostly useful for exercising a program's TLS handling without a real handshake.
+func WithDownstreamTLS(cs *tls.ConnectionState) Option {
+	return func(i *Instance) {
+		i.downstreamTLS = cs
+	}
+}
+
+// WithClientIPHeader is an Option that takes the downstream client IP address from the named
+// request header, such as "X-Forwarded-For", rather than from the connection. Only the first
+// address in the header is used, and requests without a valid one fall back to `req.RemoteAddr`.
+// Clients can set the header to anything they like, so only use this behind a proxy you trust to
+// overwrite it. An address supplied via ContextWithClientIP takes precedence over the header.
+func WithClientIPHeader(name string) Option {
+	return func(i *Instance) {
+		i.clientIPHeader = name
+	}
+}
+
 // WithUserAgentParser is an Option that converts user agent header values into UserAgent structs,
 // called when the guest code uses the user agent parser XQD call.
 func WithUserAgentParser(fn UserAgentParser) Option {
@@ -86,3 +265,173 @@ func WithVerbosity(v int) Option {
 		}
 	}
 }
+
+// WithDeterministicAsync is an Option that makes pending_req_select return the first finished
+// request in the order the guest listed them, when more than one has finished by the time it
+// returns. Without it, one of them is picked at random. It only affects ties, and never waits
+// longer than necessary for a request to finish.
+// It's meant for tests that assert on which request completed first.
+func WithDeterministicAsync() Option {
+	return func(i *Instance) {
+		i.deterministicAsync = true
+	}
+}
+
+// WithUsageReporter is an Option that calls fn once at the end of every downstream request with a
+// summary of what the guest did, including when the guest fails. Instances handle requests
+// concurrently, so fn must be safe to call from multiple goroutines.
+func WithUsageReporter(fn func(UsageReport)) Option {
+	return func(i *Instance) {
+		i.usageReporter = fn
+	}
+}
+
+// WithMaxBodySize is an Option that caps the size of bodies, so that a guest or a backend can't
+// exhaust host memory. Writes and appends that would grow a guest body past n bytes in all fail,
+// and reading past the first n bytes of a backend response body fails as if the connection
+// dropped. By default, bodies are unlimited.
+func WithMaxBodySize(n int64) Option {
+	return func(i *Instance) {
+		i.maxBodySize = n
+	}
+}
+
+// WithMaxDownstreamBodySize is an Option that limits the size of request bodies accepted from
+// clients. Requests with a Content-Length over n get a 413 response without running the program,
+// and reading past the first n bytes of any other request body fails. By default, request bodies
+// are unlimited.
+func WithMaxDownstreamBodySize(n int64) Option {
+	return func(i *Instance) {
+		i.maxDownstreamBodySize = n
+	}
+}
+
+// WithDownstreamCompression is an Option that gzips response bodies sent to clients whose
+// Accept-Encoding allows it, the way the edge compresses responses. Responses the program already
+// set a Content-Encoding on are sent as they are. Compressed responses are sent without a
+// Content-Length, and with a Vary on Accept-Encoding.
+func WithDownstreamCompression(enabled bool) Option {
+	return func(i *Instance) {
+		i.compressDownstream = enabled
+	}
+}
+
+// WithRequestContextFunc is an Option that supplies the context subrequests are sent with, in
+// place of the downstream request's. Subrequests are canceled once the context is done, or when the
+// downstream request finishes, whichever comes first. By default, it's `req.Context()`, so
+// subrequests are canceled when the client disconnects.
+func WithRequestContextFunc(fn func(*http.Request) context.Context) Option {
+	return func(i *Instance) {
+		i.requestContextFn = fn
+	}
+}
+
+// WithMetrics is an Option that sends operational metrics to m; see Metrics for what's recorded.
+// Pool metrics are only recorded when it's passed to New. Without it, no metrics are gathered.
+func WithMetrics(m Metrics) Option {
+	return func(i *Instance) {
+		i.metrics = m
+	}
+}
+
+// WithTrapHandler is an Option that writes the response when the wasm program traps, in place of
+// the default 500 with the trap message and wasm backtrace. err is the trap returned by wasmtime.
+// It isn't called for programs interrupted by WithExecutionTimeout, which get their own 500. The
+// trap is logged to stderr either way.
+func WithTrapHandler(fn func(w http.ResponseWriter, r *http.Request, err error)) Option {
+	return func(i *Instance) {
+		i.trapHandler = fn
+	}
+}
+
+// WithExecutionTimeout is an Option that interrupts the guest once it has run for d, so that a
+// runaway guest can't hold on to a request forever. An interrupted guest gets a 500 response. The
+// time spent waiting on subrequests counts towards d, but a guest is only interrupted while it's
+// running wasm code, so it takes effect once a subrequest returns.
+func WithExecutionTimeout(d time.Duration) Option {
+	return func(i *Instance) {
+		i.executionTimeout = d
+	}
+}
+
+// WithSubrequestRecorder is an Option that calls fn for every subrequest the guest sends, once the
+// backend has responded, including the SNI that was sent to BackendConfig origins reached over
+// TLS. Asynchronous subrequests are recorded from their own goroutines, so fn must be safe to call
+// concurrently.
+func WithSubrequestRecorder(fn func(Subrequest)) Option {
+	return func(i *Instance) {
+		i.subrequestRecorder = fn
+	}
+}
+
+// WithClock is an Option that replaces the system clock used by time-dependent features, such as
+// usage durations and the simulated latency of BackendConfig backends. Use a FakeClock to control
+// time in tests instead of sleeping.
+func WithClock(c Clock) Option {
+	return func(i *Instance) {
+		i.clock = c
+	}
+}
+
+// WithTimingReporter is an Option that calls fn with the time taken by each startup phase of an
+// instance. The "compile" phase compiles and links the wasm program, once per instance, including
+// the instances New creates up front. The "instantiate" phase creates the wasm instance, once per
+// request. fn must be safe to call from multiple goroutines.
+func WithTimingReporter(fn func(phase string, d time.Duration)) Option {
+	return func(i *Instance) {
+		i.timingReporter = fn
+	}
+}
+
+// WithStrictABI is an Option that makes calls to XQD methods fastlike doesn't implement trap the
+// guest, instead of returning XqdErrUnsupported. The name of the method is logged to stderr, which
+// makes it easy to find out which parts of the ABI a guest needs that fastlike lacks.
+func WithStrictABI() Option {
+	return func(i *Instance) {
+		i.strictABI = true
+	}
+}
+
+// WithABITracer is an Option that calls fn after every XQD method the guest calls, with the method
+// name, arguments, and returned status. Instances handle requests concurrently, so fn must be safe
+// to call from multiple goroutines.
+// The tracer is installed when the XQD methods are linked, so it must be supplied to New or
+// NewInstance. When no tracer is registered, calls have no extra overhead.
+func WithABITracer(fn func(ABICall)) Option {
+	return func(i *Instance) {
+		i.abiTracer = fn
+	}
+}
+
+// WithInstancePoolSize is an Option that caps the Fastlike instance pool at n instances. Requests
+// served while every instance is busy wait for one to be returned, rather than creating more.
+// It only has an effect when passed to New.
+func WithInstancePoolSize(n int) Option {
+	return func(i *Instance) {
+		i.poolSize = n
+	}
+}
+
+// WithInstanceWarmup is an Option that creates n instances when New is called, so the first burst
+// of requests doesn't pay to create them. The count is clamped to the pool size, and New always
+// creates at least one instance. The pool is warmed up again with the new program after
+// Fastlike.Reload. It only has an effect when passed to New.
+func WithInstanceWarmup(n int) Option {
+	return func(i *Instance) {
+		i.warmup = n
+	}
+}
+
+// WithInstanceReuseDisabled is an Option that makes Fastlike serve every request with a fresh
+// instance, which is thrown away afterwards instead of going back to the pool. It's a debugging aid:
+// state leaking from one request to the next can't happen with it set, so a bug that goes away
+// when it's set points at such a leak.
+// Every request pays the full cost of compiling and instantiating the wasm program, which is
+// usually far more than the cost of running it, so it shouldn't be used outside of debugging or
+// tests. WithInstanceWarmup has no effect, and WithInstancePoolSize still caps how many instances
+// are live at once. It only has an effect when passed to New.
+func WithInstanceReuseDisabled() Option {
+	return func(i *Instance) {
+		i.reuseDisabled = true
+	}
+}
@@ -0,0 +1,136 @@
+package fastlike
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// tlsWat is a guest which responds with the downstream tls protocol and cipher, separated by a space
+const tlsWat = `
+(module
+  (import "fastly_http_req" "downstream_tls_protocol" (func $protocol (param i32 i32 i32) (result i32)))
+  (import "fastly_http_req" "downstream_tls_cipher_openssl_name" (func $cipher (param i32 i32 i32) (result i32)))
+  (import "fastly_http_resp" "new" (func $resp_new (param i32) (result i32)))
+  (import "fastly_http_body" "new" (func $body_new (param i32) (result i32)))
+  (import "fastly_http_body" "write" (func $body_write (param i32 i32 i32 i32 i32) (result i32)))
+  (import "fastly_http_resp" "send_downstream" (func $send_downstream (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 96) " ")
+  (func (export "_start")
+    (drop (call $protocol (i32.const 100) (i32.const 64) (i32.const 0)))
+    (drop (call $cipher (i32.const 200) (i32.const 64) (i32.const 4)))
+    (drop (call $resp_new (i32.const 8)))
+    (drop (call $body_new (i32.const 12)))
+    (drop (call $body_write (i32.load (i32.const 12)) (i32.const 100) (i32.load (i32.const 0)) (i32.const 0) (i32.const 16)))
+    (drop (call $body_write (i32.load (i32.const 12)) (i32.const 96) (i32.const 1) (i32.const 0) (i32.const 16)))
+    (drop (call $body_write (i32.load (i32.const 12)) (i32.const 200) (i32.load (i32.const 4)) (i32.const 0) (i32.const 16)))
+    (drop (call $send_downstream (i32.load (i32.const 8)) (i32.load (i32.const 12)) (i32.const 0)))))
+`
+
+func TestDownstreamTLS(t *testing.T) {
+	var cs = &tls.ConnectionState{
+		Version:     tls.VersionTLS12,
+		CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+
+	var cases = []struct {
+		name     string
+		request  func() *http.Request
+		protocol string
+		cipher   string
+	}{
+		{"request", func() *http.Request {
+			r, _ := http.NewRequest("GET", "https://localhost:1337/", nil)
+			r.TLS = cs
+			return r
+		}, "TLSv1.2", "ECDHE-RSA-AES128-GCM-SHA256"},
+		{"context", func() *http.Request {
+			r, _ := http.NewRequest("GET", "https://localhost:1337/", nil)
+			return r.WithContext(ContextWithTLSState(r.Context(), cs))
+		}, "TLSv1.2", "ECDHE-RSA-AES128-GCM-SHA256"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			i := newTestInstance(st)
+			i.ds_request = c.request()
+
+			if !i.secureFn(i.ds_request) {
+				st.Error("expected request to be secure")
+			}
+
+			if s := i.xqd_req_downstream_tls_protocol(100, 64, 0); s != XqdStatusOK {
+				st.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+			}
+			if p := string(i.memory.Data()[100 : 100+i.memory.Uint32(0)]); p != c.protocol {
+				st.Errorf("expected protocol %q, got %q", c.protocol, p)
+			}
+
+			if s := i.xqd_req_downstream_tls_cipher_openssl_name(100, 64, 0); s != XqdStatusOK {
+				st.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+			}
+			if p := string(i.memory.Data()[100 : 100+i.memory.Uint32(0)]); p != c.cipher {
+				st.Errorf("expected cipher %q, got %q", c.cipher, p)
+			}
+		})
+	}
+
+	t.Run("insecure", func(st *testing.T) {
+		i := newTestInstance(st)
+		i.ds_request, _ = http.NewRequest("GET", "http://localhost:1337/", nil)
+
+		if s := i.xqd_req_downstream_tls_protocol(100, 64, 0); s != XqdErrNone {
+			st.Errorf("expected status %d, got %d", XqdErrNone, s)
+		}
+	})
+}
+
+func TestDownstreamTLSOption(t *testing.T) {
+	var cs = &tls.ConnectionState{
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+	}
+
+	w := serve(t, tlsWat, httptest.NewRequest("GET", "http://localhost:1337/", nil), WithDownstreamTLS(cs))
+	if body := w.Body.String(); body != "TLSv1.3 TLS_AES_128_GCM_SHA256" {
+		t.Errorf("unexpected response %q", body)
+	}
+}
+
+func TestDownstreamTLSServer(t *testing.T) {
+	srv := httptest.NewTLSServer(newTestFastlike(t, tlsWat))
+	defer srv.Close()
+
+	var cases = []struct {
+		name   string
+		config *tls.Config
+	}{
+		{"tls1.2", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}}},
+		{"tls1.3", &tls.Config{MinVersion: tls.VersionTLS13}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			var client = srv.Client()
+			var transport = client.Transport.(*http.Transport).Clone()
+			c.config.RootCAs = transport.TLSClientConfig.RootCAs
+			transport.TLSClientConfig = c.config
+			client.Transport = transport
+
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				st.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			var expected = tlsProtocolName(resp.TLS.Version) + " " + tlsCipherName(resp.TLS.CipherSuite)
+			if string(body) != expected {
+				st.Errorf("expected %q, got %q", expected, body)
+			}
+		})
+	}
+}
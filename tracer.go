@@ -0,0 +1,38 @@
+package fastlike
+
+import (
+	"reflect"
+)
+
+// ABICall describes a single call made by a wasm guest into an XQD method
+type ABICall struct {
+	// Module and Name identify the method, ex: fastly_http_req::send
+	Module string
+	Name   string
+
+	// Args are the integer arguments the guest supplied, in order
+	Args []int64
+
+	// Status is the status returned to the guest, or 0 for methods that don't return one
+	Status int32
+}
+
+// traceFunc wraps an XQD method implementation so that tracer is called with the details of each
+// call after it returns
+func traceFunc(tracer func(ABICall), module, name string, fn interface{}) interface{} {
+	var v = reflect.ValueOf(fn)
+	return reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+		var call = ABICall{Module: module, Name: name, Args: make([]int64, len(args))}
+		for j, a := range args {
+			call.Args[j] = a.Int()
+		}
+
+		results := v.Call(args)
+		if len(results) > 0 && results[0].Kind() == reflect.Int32 {
+			call.Status = int32(results[0].Int())
+		}
+
+		tracer(call)
+		return results
+	}).Interface()
+}
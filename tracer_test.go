@@ -0,0 +1,49 @@
+package fastlike
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestABITracer(t *testing.T) {
+	var mu sync.Mutex
+	var calls = []ABICall{}
+	tracer := WithABITracer(func(call ABICall) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	})
+
+	r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+	w := serve(t, helloWat, r, tracer)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var expected = []ABICall{
+		{"fastly_abi", "init", []int64{1}, XqdStatusOK},
+		{"fastly_http_resp", "new", []int64{0}, XqdStatusOK},
+		{"fastly_http_body", "new", []int64{4}, XqdStatusOK},
+		{"fastly_http_body", "write", []int64{0, 64, 13, 0, 8}, XqdStatusOK},
+		{"fastly_http_resp", "send_downstream", []int64{0, 0, 0}, XqdStatusOK},
+	}
+
+	if len(calls) != len(expected) {
+		t.Fatalf("expected %d calls, got %d: %+v", len(expected), len(calls), calls)
+	}
+
+	for j, e := range expected {
+		c := calls[j]
+		if c.Module != e.Module || c.Name != e.Name || c.Status != e.Status || len(c.Args) != len(e.Args) {
+			t.Errorf("call %d: expected %+v, got %+v", j, e, c)
+			continue
+		}
+		for k := range e.Args {
+			if c.Args[k] != e.Args[k] {
+				t.Errorf("call %d: expected %+v, got %+v", j, e, c)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package fastlike
+
+import (
+	"time"
+)
+
+// UsageReport summarizes the resources a guest used while handling a single downstream request
+type UsageReport struct {
+	// Subrequests is the number of requests the guest sent to backends, including async ones.
+	// Mirrored copies aren't counted.
+	Subrequests int
+
+	// LogBytes is the number of bytes the guest wrote to log endpoints
+	LogBytes int64
+
+	// BodyBytesRead and BodyBytesWritten are the number of bytes the guest read from and wrote
+	// to bodies, across all body handles
+	BodyBytesRead    int64
+	BodyBytesWritten int64
+
+	// Duration is the wall-clock time spent handling the request. The guest's CPU time isn't
+	// measured separately.
+	Duration time.Duration
+
+	// Err is the error returned by the guest, if it trapped or was interrupted
+	Err error
+}
+
+// report calls the usage reporter, if there is one, with the usage gathered for the request that
+// started at start
+func (i *Instance) report(start time.Time, err error) {
+	if i.usageReporter == nil {
+		return
+	}
+
+	var usage = i.usage
+	usage.Duration = i.clock.Now().Sub(start)
+	usage.Err = err
+	i.usageReporter(usage)
+}
@@ -0,0 +1,46 @@
+package fastlike
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUsageReporter(t *testing.T) {
+	const trapWat = `(module (memory (export "memory") 1) (func (export "_start") unreachable))`
+
+	var cases = []struct {
+		name   string
+		src    string
+		expect func(UsageReport) bool
+	}{
+		{"hello", helloWat, func(u UsageReport) bool {
+			return u.BodyBytesWritten == 13 && u.Subrequests == 0 && u.Err == nil
+		}},
+		{"proxy", proxyWat, func(u UsageReport) bool {
+			return u.Subrequests == 1 && u.Err == nil
+		}},
+		{"trap", trapWat, func(u UsageReport) bool {
+			return u.Err != nil
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			var reports []UsageReport
+			backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+			serve(st, c.src, httptest.NewRequest("GET", "http://localhost:1337/", nil),
+				WithBackend("backend", backend),
+				WithUsageReporter(func(u UsageReport) { reports = append(reports, u) }),
+			)
+
+			if len(reports) != 1 {
+				st.Fatalf("expected exactly one usage report, got %d", len(reports))
+			}
+			if !c.expect(reports[0]) || reports[0].Duration <= 0 {
+				st.Errorf("unexpected usage report %+v", reports[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package fastlike
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// VCRMode controls what WithBackendVCR does with subrequests
+type VCRMode int
+
+const (
+	// VCRRecord sends subrequests to the backend as usual, and saves each response to the
+	// recording. A response replaces any earlier one recorded for the same request.
+	VCRRecord VCRMode = iota
+
+	// VCRReplay serves subrequests from the recording, without sending them to the backend.
+	// Subrequests that weren't recorded get a 502.
+	VCRReplay
+
+	// VCRReplayOrPassthrough serves subrequests from the recording, and sends the ones that weren't
+	// recorded to the backend without recording them.
+	VCRReplayOrPassthrough
+)
+
+// vcrMatchHeaders are the request headers, besides the method and URL, which have to match for a
+// recorded response to be replayed
+var vcrMatchHeaders = []string{"Accept", "Accept-Encoding", "Content-Type"}
+
+// vcrCassette is the on-disk format of a recording, stored as JSON
+type vcrCassette struct {
+	Interactions []vcrInteraction `json:"interactions"`
+}
+
+type vcrInteraction struct {
+	Request  vcrRequest  `json:"request"`
+	Response vcrResponse `json:"response"`
+}
+
+// vcrRequest holds the parts of a subrequest used to match it. Request bodies aren't stored, only
+// their SHA-256, which is left out for requests without a body.
+type vcrRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Headers    http.Header `json:"headers,omitempty"`
+	BodySHA256 string      `json:"body_sha256,omitempty"`
+}
+
+// vcrResponse is a recorded response. The body is stored base64-encoded, so that it comes back
+// byte for byte.
+type vcrResponse struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    []byte      `json:"body"`
+}
+
+// newVCRRequest returns the parts of r used to match it. The body has to be read to hash it, so
+// it's replaced with a copy that can be sent on.
+func newVCRRequest(r *http.Request) (vcrRequest, error) {
+	var vr = vcrRequest{Method: r.Method, URL: r.URL.String()}
+	for _, h := range vcrMatchHeaders {
+		if v, ok := r.Header[h]; ok {
+			if vr.Headers == nil {
+				vr.Headers = http.Header{}
+			}
+			vr.Headers[h] = v
+		}
+	}
+
+	if r.Body == nil || r.Body == http.NoBody {
+		return vr, nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return vr, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if len(body) > 0 {
+		vr.BodySHA256 = fmt.Sprintf("%x", sha256.Sum256(body))
+	}
+	return vr, nil
+}
+
+// key returns a string identifying the request for matching
+func (r vcrRequest) key() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s", r.Method, r.URL)
+	for _, h := range vcrMatchHeaders {
+		fmt.Fprintf(&buf, "\n%s: %q", h, r.Headers[h])
+	}
+	fmt.Fprintf(&buf, "\n%s", r.BodySHA256)
+	return buf.String()
+}
+
+// vcr records subrequests to a file, or replays them from it. It's shared by every instance
+// created with the same Option, so recordings from concurrent requests end up in the same file.
+type vcr struct {
+	path string
+	mode VCRMode
+
+	mu       sync.Mutex
+	cassette vcrCassette
+}
+
+func newVCR(path string, mode VCRMode) (*vcr, error) {
+	var v = &vcr{path: path, mode: mode}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && mode == VCRRecord {
+		return v, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &v.cassette); err != nil {
+		return nil, fmt.Errorf("error parsing recording %s, got %s", path, err.Error())
+	}
+
+	return v, nil
+}
+
+func (v *vcr) find(r vcrRequest) (vcrResponse, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, in := range v.cassette.Interactions {
+		if in.Request.key() == r.key() {
+			return in.Response, true
+		}
+	}
+	return vcrResponse{}, false
+}
+
+// save adds an interaction to the recording and writes it out. The file is replaced in one go, so
+// it's never left half written.
+func (v *vcr) save(in vcrInteraction) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var replaced = false
+	for j, old := range v.cassette.Interactions {
+		if old.Request.key() == in.Request.key() {
+			v.cassette.Interactions[j], replaced = in, true
+		}
+	}
+	if !replaced {
+		v.cassette.Interactions = append(v.cassette.Interactions, in)
+	}
+
+	data, err := json.MarshalIndent(v.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(v.path), filepath.Base(v.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), v.path)
+}
+
+// transport returns an http.RoundTripper which records or replays the subrequests sent with rt
+func (v *vcr) transport(rt http.RoundTripper) http.RoundTripper {
+	return vcrTransport{v, rt}
+}
+
+type vcrTransport struct {
+	vcr *vcr
+	rt  http.RoundTripper
+}
+
+func (t vcrTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	vr, err := newVCRRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.vcr.mode == VCRRecord {
+		return t.record(vr, r)
+	}
+
+	if recorded, ok := t.vcr.find(vr); ok {
+		return &http.Response{
+			Status:        statusLine(recorded.Status),
+			StatusCode:    recorded.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        recorded.Headers.Clone(),
+			Body:          ioutil.NopCloser(bytes.NewReader(recorded.Body)),
+			ContentLength: int64(len(recorded.Body)),
+			Request:       r,
+		}, nil
+	}
+
+	if t.vcr.mode == VCRReplayOrPassthrough {
+		return t.rt.RoundTrip(r)
+	}
+
+	return nil, fmt.Errorf("no recorded response in %s for %s %s", t.vcr.path, r.Method, r.URL)
+}
+
+// record sends the subrequest on and saves the response once its body has been read in full. Bodies
+// that fail partway through are passed on as they are, and not recorded.
+func (t vcrTransport) record(vr vcrRequest, r *http.Request) (*http.Response, error) {
+	res, err := t.rt.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		res.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+		return res, nil
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var in = vcrInteraction{
+		Request:  vr,
+		Response: vcrResponse{Status: res.StatusCode, Headers: res.Header.Clone(), Body: body},
+	}
+	if err := t.vcr.save(in); err != nil {
+		fmt.Printf("Warning: error saving recording %s, got %s\n", t.vcr.path, err.Error())
+	}
+
+	return res, nil
+}
+
+// vcrDir keeps a recording for every backend in a directory, named after the backend. Recordings
+// are opened the first time their backend is used.
+type vcrDir struct {
+	dir  string
+	mode VCRMode
+
+	mu   sync.Mutex
+	vcrs map[string]*vcr
+}
+
+func newVCRDir(dir string, mode VCRMode) (*vcrDir, error) {
+	if mode == VCRRecord {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	return &vcrDir{dir: dir, mode: mode, vcrs: map[string]*vcr{}}, nil
+}
+
+// get returns the recording for the named backend. A backend that was never recorded gets an empty
+// one, so that replaying it fails for each subrequest instead of all at once. If the recording
+// can't be read, a warning is printed and nil is returned.
+func (d *vcrDir) get(backend string) *vcr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if v, ok := d.vcrs[backend]; ok {
+		return v
+	}
+
+	var path = filepath.Join(d.dir, url.PathEscape(backend)+".json")
+	var v *vcr
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		v = &vcr{path: path, mode: d.mode}
+	} else if v, err = newVCR(path, d.mode); err != nil {
+		fmt.Printf("Warning: not using recording for backend %s, got %s\n", backend, err.Error())
+		return nil
+	}
+
+	d.vcrs[backend] = v
+	return v
+}
@@ -0,0 +1,135 @@
+package fastlike
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBackendVCR(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "origin.json")
+
+	// Every byte value, to make sure bodies round-trip exactly
+	var payload = make([]byte, 256)
+	for j := range payload {
+		payload[j] = byte(j)
+	}
+
+	var hits int32
+	var origin = WithBackend("origin", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("x-origin", "real")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(payload)
+	}))
+
+	var check = func(i *Instance, backend string, status int, body []byte) {
+		t.Helper()
+		wh, bh := send(t, i, backend)
+		var w = i.responses.Get(int(wh))
+		got, _ := ioutil.ReadAll(i.bodies.Get(int(bh)))
+		if w.StatusCode != status || !bytes.Equal(got, body) {
+			t.Errorf("%s: expected %d with a %d byte body, got %d with %d bytes", backend, status, len(body), w.StatusCode, len(got))
+		}
+	}
+
+	// del sends a DELETE to the origin backend, which the recording doesn't have
+	var del = func(i *Instance) int {
+		rhid, rh := i.requests.New()
+		rh.Method = "DELETE"
+		rh.URL, _ = url.Parse("http://localhost/origin")
+		bhid, _ := i.bodies.NewBuffer()
+		i.memory.WriteAt([]byte("origin"), 200)
+		i.xqd_req_send(int32(rhid), int32(bhid), 200, 6, 100, 104)
+		return i.responses.Get(int(i.memory.Uint32(100))).StatusCode
+	}
+
+	i := newTestInstance(t, origin, WithBackendVCR("origin", path, VCRRecord))
+	check(i, "origin", http.StatusCreated, payload)
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("expected recording to reach the origin once, got %d", n)
+	}
+
+	// Replaying never reaches the origin, and misses are an error
+	i = newTestInstance(t, origin, WithBackendVCR("origin", path, VCRReplay))
+	check(i, "origin", http.StatusCreated, payload)
+	if w := i.responses.Get(int(i.memory.Uint32(100))); w.Header.Get("x-origin") != "real" {
+		t.Errorf("expected recorded headers to be replayed, got %v", w.Header)
+	}
+
+	if code := del(i); code != http.StatusBadGateway {
+		t.Errorf("expected a replay miss to respond %d, got %d", http.StatusBadGateway, code)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("expected replay not to reach the origin, got %d hits", n)
+	}
+
+	// Passthrough sends misses on to the origin
+	i = newTestInstance(t, origin, WithBackendVCR("origin", path, VCRReplayOrPassthrough))
+	if code := del(i); code != http.StatusCreated {
+		t.Errorf("expected a passthrough miss to reach the origin, got %d", code)
+	}
+}
+
+func TestBackendRecording(t *testing.T) {
+	var dir = filepath.Join(t.TempDir(), "recordings")
+
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("x-origin", "real")
+		w.Write([]byte(r.Method + " " + string(body)))
+	}))
+	var origin = WithBackendConfig("origin", BackendConfig{URL: server.URL})
+
+	// post sends a POST with the given body to the origin backend, returning the response
+	var post = func(i *Instance, body string) (int, string) {
+		rhid, rh := i.requests.New()
+		rh.Method = "POST"
+		rh.URL, _ = url.Parse("http://localhost/origin")
+		bhid, bh := i.bodies.NewBuffer()
+		bh.Write([]byte(body))
+		i.memory.WriteAt([]byte("origin"), 200)
+		i.xqd_req_send(int32(rhid), int32(bhid), 200, 6, 100, 104)
+
+		var w = i.responses.Get(int(i.memory.Uint32(100)))
+		got, _ := ioutil.ReadAll(i.bodies.Get(int(i.memory.Uint32(104))))
+		return w.StatusCode, string(got)
+	}
+
+	i := newTestInstance(t, origin, WithBackendRecording(dir, VCRRecord))
+	if code, body := post(i, "one"); code != http.StatusOK || body != "POST one" {
+		t.Fatalf("expected recording to reach the origin, got %d %q", code, body)
+	}
+	post(i, "two")
+	server.Close()
+
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "origin.json")); err != nil {
+		t.Fatalf("expected a recording for the origin backend, got %s", err.Error())
+	}
+
+	// The server is gone, so these can only come from the recording
+	i = newTestInstance(t, origin, WithBackendRecording(dir, VCRReplay))
+	for _, body := range []string{"one", "two"} {
+		if code, got := post(i, body); code != http.StatusOK || got != "POST "+body {
+			t.Errorf("expected %q to be replayed, got %d %q", body, code, got)
+		}
+	}
+	if w := i.responses.Get(int(i.memory.Uint32(100))); w.Header.Get("x-origin") != "real" {
+		t.Errorf("expected recorded headers to be replayed, got %v", w.Header)
+	}
+
+	// Bodies are part of the match, and backends that were never recorded miss too
+	if code, _ := post(i, "three"); code != http.StatusBadGateway {
+		t.Errorf("expected an unrecorded body to respond %d, got %d", http.StatusBadGateway, code)
+	}
+	i = newTestInstance(t, WithBackendConfig("other", BackendConfig{URL: server.URL}), WithBackendRecording(dir, VCRReplay))
+	wh, _ := send(t, i, "other")
+	if code := i.responses.Get(int(wh)).StatusCode; code != http.StatusBadGateway {
+		t.Errorf("expected an unrecorded backend to respond %d, got %d", http.StatusBadGateway, code)
+	}
+}
@@ -1,6 +1,9 @@
 package fastlike
 
 import (
+	"strings"
+	"time"
+
 	"github.com/bytecodealliance/wasmtime-go"
 )
 
@@ -9,9 +12,44 @@ type wasmContext struct {
 	wasi   *wasmtime.WasiInstance
 	module *wasmtime.Module
 	linker *wasmtime.Linker
+	abi    abi
+}
+
+// abi is a bitmask describing which set(s) of XQD imports a wasm module was built against
+type abi int
+
+const (
+	// abiModern is the ABI using a module per subsystem (fastly_abi, fastly_http_req, etc)
+	abiModern abi = 1 << iota
+	// abiLegacy is the ABI with most methods in the `env` module prefixed with `xqd_`
+	abiLegacy
+)
+
+// detectABI inspects the imports of a module to determine which ABI it was built against. Modules
+// with no XQD imports at all are treated as modern.
+func detectABI(module *wasmtime.Module) abi {
+	var rv abi
+	for _, imp := range module.Imports() {
+		switch m := imp.Module(); {
+		case m == "fastly_uap":
+			// fastly_uap is shared by both ABIs, so it doesn't tell us anything
+		case m == "env" || m == "fastly":
+			rv |= abiLegacy
+		case strings.HasPrefix(m, "fastly_"):
+			rv |= abiModern
+		}
+	}
+
+	if rv == 0 {
+		rv = abiModern
+	}
+
+	return rv
 }
 
 func (i *Instance) compile(wasmbytes []byte) {
+	defer i.timing("compile", time.Now())
+
 	config := wasmtime.NewConfig()
 
 	check(config.CacheConfigLoadDefault())
@@ -31,94 +69,109 @@ func (i *Instance) compile(wasmbytes []byte) {
 	linker := wasmtime.NewLinker(store)
 	check(linker.DefineWasi(wasi))
 
-	i.link(linker)
-	i.linklegacy(linker)
+	// Only link the ABI the module actually imports, so we don't define a bunch of functions the
+	// guest will never call
+	abi := detectABI(module)
+	if abi&abiModern != 0 {
+		i.link(linker)
+	}
+	if abi&abiLegacy != 0 {
+		i.linklegacy(linker)
+	}
 
 	i.wasmctx = &wasmContext{
 		store:  store,
 		wasi:   wasi,
 		module: module,
 		linker: linker,
+		abi:    abi,
+	}
+}
+
+// define links fn as module::name, wrapping it with the abi tracer if there is one
+func (i *Instance) define(linker *wasmtime.Linker, module, name string, fn interface{}) {
+	if i.abiTracer != nil {
+		fn = traceFunc(i.abiTracer, module, name, fn)
 	}
+
+	linker.DefineFunc(module, name, fn)
 }
 
 func (i *Instance) link(linker *wasmtime.Linker) {
 	// XQD Stubbing -{{{
 	// TODO: All of these XQD methods are stubbed. As they are implemented, they'll be removed from
 	// here and explicitly linked in the section below.
-	linker.DefineFunc("fastly_http_req", "pending_req_poll", i.wasm4("pending_req_poll"))
-	linker.DefineFunc("fastly_http_req", "pending_req_select", i.wasm5("pending_req_select"))
-	linker.DefineFunc("fastly_http_req", "pending_req_wait", i.wasm3("pending_req_wait"))
-
-	linker.DefineFunc("fastly_http_req", "downstream_tls_cipher_openssl_name", i.wasm3("downstream_tls_cipher_openssl_name"))
-	linker.DefineFunc("fastly_http_req", "downstream_tls_protocol", i.wasm3("downstream_tls_protocol"))
-	linker.DefineFunc("fastly_http_req", "downstream_tls_client_hello", i.wasm3("downstream_tls_client_hello"))
-
-	linker.DefineFunc("fastly_http_req", "header_insert", i.wasm5("header_insert"))
-	linker.DefineFunc("fastly_http_req", "send_async", i.wasm5("send_async"))
+	i.define(linker, "fastly_http_req", "downstream_tls_client_hello", i.wasm3("downstream_tls_client_hello"))
 
-	linker.DefineFunc("fastly_http_req", "original_header_count", i.wasm1("original_header_count"))
+	i.define(linker, "fastly_http_req", "header_insert", i.wasm5("header_insert"))
 
-	linker.DefineFunc("fastly_http_resp", "header_append", i.wasm5("header_append"))
-	linker.DefineFunc("fastly_http_resp", "header_insert", i.wasm5("header_insert"))
-	linker.DefineFunc("fastly_http_resp", "header_value_get", i.wasm6("header_value_get"))
-	linker.DefineFunc("fastly_http_resp", "header_remove", i.wasm3("header_remove"))
+	i.define(linker, "fastly_http_resp", "header_append", i.wasm5("header_append"))
+	i.define(linker, "fastly_http_resp", "header_insert", i.wasm5("header_insert"))
+	i.define(linker, "fastly_http_resp", "header_value_get", i.wasm6("header_value_get"))
+	i.define(linker, "fastly_http_resp", "header_remove", i.wasm3("header_remove"))
 	// End XQD Stubbing -}}}
 
 	// xqd.go
-	linker.DefineFunc("fastly_abi", "init", i.xqd_init)
-	linker.DefineFunc("fastly_uap", "parse", i.xqd_uap_parse)
+	i.define(linker, "fastly_abi", "init", i.xqd_init)
+	i.define(linker, "fastly_uap", "parse", i.xqd_uap_parse)
 
 	// xqd_request.go
-	linker.DefineFunc("fastly_http_req", "body_downstream_get", i.xqd_req_body_downstream_get)
-	linker.DefineFunc("fastly_http_req", "downstream_client_ip_addr", i.xqd_req_downstream_client_ip_addr)
-	linker.DefineFunc("fastly_http_req", "new", i.xqd_req_new)
-	linker.DefineFunc("fastly_http_req", "version_get", i.xqd_req_version_get)
-	linker.DefineFunc("fastly_http_req", "version_set", i.xqd_req_version_set)
-	linker.DefineFunc("fastly_http_req", "method_get", i.xqd_req_method_get)
-	linker.DefineFunc("fastly_http_req", "method_set", i.xqd_req_method_set)
-	linker.DefineFunc("fastly_http_req", "uri_get", i.xqd_req_uri_get)
-	linker.DefineFunc("fastly_http_req", "uri_set", i.xqd_req_uri_set)
-	linker.DefineFunc("fastly_http_req", "header_names_get", i.xqd_req_header_names_get)
-	linker.DefineFunc("fastly_http_req", "header_remove", i.xqd_req_header_remove)
-	linker.DefineFunc("fastly_http_req", "header_value_get", i.xqd_req_header_value_get)
-	linker.DefineFunc("fastly_http_req", "header_values_get", i.xqd_req_header_values_get)
-	linker.DefineFunc("fastly_http_req", "header_values_set", i.xqd_req_header_values_set)
-	linker.DefineFunc("fastly_http_req", "send", i.xqd_req_send)
-	linker.DefineFunc("fastly_http_req", "cache_override_set", i.xqd_req_cache_override_set)
-	linker.DefineFunc("fastly_http_req", "cache_override_v2_set", i.xqd_req_cache_override_v2_set)
+	i.define(linker, "fastly_http_req", "body_downstream_get", i.xqd_req_body_downstream_get)
+	i.define(linker, "fastly_http_req", "downstream_client_ip_addr", i.xqd_req_downstream_client_ip_addr)
+	i.define(linker, "fastly_http_req", "downstream_tls_cipher_openssl_name", i.xqd_req_downstream_tls_cipher_openssl_name)
+	i.define(linker, "fastly_http_req", "downstream_tls_protocol", i.xqd_req_downstream_tls_protocol)
+	i.define(linker, "fastly_http_req", "new", i.xqd_req_new)
+	i.define(linker, "fastly_http_req", "version_get", i.xqd_req_version_get)
+	i.define(linker, "fastly_http_req", "version_set", i.xqd_req_version_set)
+	i.define(linker, "fastly_http_req", "method_get", i.xqd_req_method_get)
+	i.define(linker, "fastly_http_req", "method_set", i.xqd_req_method_set)
+	i.define(linker, "fastly_http_req", "uri_get", i.xqd_req_uri_get)
+	i.define(linker, "fastly_http_req", "uri_set", i.xqd_req_uri_set)
+	i.define(linker, "fastly_http_req", "header_names_get", i.xqd_req_header_names_get)
+	i.define(linker, "fastly_http_req", "header_remove", i.xqd_req_header_remove)
+	i.define(linker, "fastly_http_req", "header_value_get", i.xqd_req_header_value_get)
+	i.define(linker, "fastly_http_req", "header_values_get", i.xqd_req_header_values_get)
+	i.define(linker, "fastly_http_req", "header_values_set", i.xqd_req_header_values_set)
+	i.define(linker, "fastly_http_req", "send", i.xqd_req_send)
+	i.define(linker, "fastly_http_req", "send_async", i.xqd_req_send_async)
+	i.define(linker, "fastly_http_req", "pending_req_poll", i.xqd_pending_req_poll)
+	i.define(linker, "fastly_http_req", "pending_req_wait", i.xqd_pending_req_wait)
+	i.define(linker, "fastly_http_req", "pending_req_select", i.xqd_pending_req_select)
+	i.define(linker, "fastly_http_req", "cache_override_set", i.xqd_req_cache_override_set)
+	i.define(linker, "fastly_http_req", "cache_override_v2_set", i.xqd_req_cache_override_v2_set)
 	// The Go http implementation doesn't make it easy to get at the original headers in order, so
 	// we just use the same sorted order
-	linker.DefineFunc("fastly_http_req", "original_header_names_get", i.xqd_req_header_names_get)
-	linker.DefineFunc("fastly_http_req", "close", i.xqd_req_close)
+	i.define(linker, "fastly_http_req", "original_header_names_get", i.xqd_req_original_header_names_get)
+	i.define(linker, "fastly_http_req", "original_header_count", i.xqd_req_original_header_count)
+	i.define(linker, "fastly_http_req", "close", i.xqd_req_close)
 
 	// xqd_response.go
-	linker.DefineFunc("fastly_http_resp", "send_downstream", i.xqd_resp_send_downstream)
-	linker.DefineFunc("fastly_http_resp", "new", i.xqd_resp_new)
-	linker.DefineFunc("fastly_http_resp", "status_get", i.xqd_resp_status_get)
-	linker.DefineFunc("fastly_http_resp", "status_set", i.xqd_resp_status_set)
-	linker.DefineFunc("fastly_http_resp", "version_get", i.xqd_resp_version_get)
-	linker.DefineFunc("fastly_http_resp", "version_set", i.xqd_resp_version_set)
-	linker.DefineFunc("fastly_http_resp", "header_names_get", i.xqd_resp_header_names_get)
-	linker.DefineFunc("fastly_http_resp", "header_remove", i.xqd_resp_header_remove)
-	linker.DefineFunc("fastly_http_resp", "header_values_get", i.xqd_resp_header_values_get)
-	linker.DefineFunc("fastly_http_resp", "header_values_set", i.xqd_resp_header_values_set)
-	linker.DefineFunc("fastly_http_resp", "close", i.xqd_resp_close)
+	i.define(linker, "fastly_http_resp", "send_downstream", i.xqd_resp_send_downstream)
+	i.define(linker, "fastly_http_resp", "new", i.xqd_resp_new)
+	i.define(linker, "fastly_http_resp", "status_get", i.xqd_resp_status_get)
+	i.define(linker, "fastly_http_resp", "status_set", i.xqd_resp_status_set)
+	i.define(linker, "fastly_http_resp", "version_get", i.xqd_resp_version_get)
+	i.define(linker, "fastly_http_resp", "version_set", i.xqd_resp_version_set)
+	i.define(linker, "fastly_http_resp", "header_names_get", i.xqd_resp_header_names_get)
+	i.define(linker, "fastly_http_resp", "header_remove", i.xqd_resp_header_remove)
+	i.define(linker, "fastly_http_resp", "header_values_get", i.xqd_resp_header_values_get)
+	i.define(linker, "fastly_http_resp", "header_values_set", i.xqd_resp_header_values_set)
+	i.define(linker, "fastly_http_resp", "close", i.xqd_resp_close)
 
 	// xqd_body.go
-	linker.DefineFunc("fastly_http_body", "new", i.xqd_body_new)
-	linker.DefineFunc("fastly_http_body", "write", i.xqd_body_write)
-	linker.DefineFunc("fastly_http_body", "read", i.xqd_body_read)
-	linker.DefineFunc("fastly_http_body", "append", i.xqd_body_append)
-	linker.DefineFunc("fastly_http_body", "close", i.xqd_body_close)
+	i.define(linker, "fastly_http_body", "new", i.xqd_body_new)
+	i.define(linker, "fastly_http_body", "write", i.xqd_body_write)
+	i.define(linker, "fastly_http_body", "read", i.xqd_body_read)
+	i.define(linker, "fastly_http_body", "append", i.xqd_body_append)
+	i.define(linker, "fastly_http_body", "close", i.xqd_body_close)
 
 	// xqd_log.go
-	linker.DefineFunc("fastly_log", "endpoint_get", i.xqd_log_endpoint_get)
-	linker.DefineFunc("fastly_log", "write", i.xqd_log_write)
+	i.define(linker, "fastly_log", "endpoint_get", i.xqd_log_endpoint_get)
+	i.define(linker, "fastly_log", "write", i.xqd_log_write)
 
 	// xqd_dictionary.go
-	linker.DefineFunc("fastly_dictionary", "open", i.xqd_dictionary_open)
-	linker.DefineFunc("fastly_dictionary", "get", i.xqd_dictionary_get)
+	i.define(linker, "fastly_dictionary", "open", i.xqd_dictionary_open)
+	i.define(linker, "fastly_dictionary", "get", i.xqd_dictionary_get)
 }
 
 // linklegacy links in the abi methods using the legacy method names
@@ -126,74 +179,72 @@ func (i *Instance) linklegacy(linker *wasmtime.Linker) {
 	// XQD Stubbing -{{{
 	// TODO: All of these XQD methods are stubbed. As they are implemented, they'll be removed from
 	// here and explicitly linked in the section below.
-	linker.DefineFunc("env", "xqd_pending_req_poll", i.wasm4("xqd_pending_req_poll"))
-	linker.DefineFunc("env", "xqd_pending_req_select", i.wasm5("xqd_pending_req_select"))
-	linker.DefineFunc("env", "xqd_pending_req_wait", i.wasm3("xqd_pending_req_wait"))
-
-	linker.DefineFunc("env", "xqd_req_downstream_tls_cipher_openssl_name", i.wasm3("xqd_req_downstream_tls_cipher_openssl_name"))
-	linker.DefineFunc("env", "xqd_req_downstream_tls_protocol", i.wasm3("xqd_req_downstream_tls_protocol"))
-	linker.DefineFunc("env", "xqd_req_downstream_tls_client_hello", i.wasm3("xqd_req_downstream_tls_client_hello"))
-
-	linker.DefineFunc("env", "xqd_req_header_insert", i.wasm5("xqd_req_header_insert"))
-	linker.DefineFunc("env", "xqd_req_send_async", i.wasm5("xqd_req_send_async"))
+	i.define(linker, "env", "xqd_req_downstream_tls_client_hello", i.wasm3("xqd_req_downstream_tls_client_hello"))
 
-	linker.DefineFunc("env", "xqd_req_original_header_count", i.wasm1("xqd_req_original_header_count"))
+	i.define(linker, "env", "xqd_req_header_insert", i.wasm5("xqd_req_header_insert"))
 
-	linker.DefineFunc("env", "xqd_resp_header_append", i.wasm5("xqd_resp_header_append"))
-	linker.DefineFunc("env", "xqd_resp_header_insert", i.wasm5("xqd_resp_header_insert"))
-	linker.DefineFunc("env", "xqd_resp_header_value_get", i.wasm6("xqd_resp_header_value_get"))
+	i.define(linker, "env", "xqd_resp_header_append", i.wasm5("xqd_resp_header_append"))
+	i.define(linker, "env", "xqd_resp_header_insert", i.wasm5("xqd_resp_header_insert"))
+	i.define(linker, "env", "xqd_resp_header_value_get", i.wasm6("xqd_resp_header_value_get"))
 
-	linker.DefineFunc("env", "xqd_body_close_downstream", i.xqd_body_close)
+	i.define(linker, "env", "xqd_body_close_downstream", i.xqd_body_close)
 	// End XQD Stubbing -}}}
 
 	// xqd.go
-	linker.DefineFunc("fastly", "init", i.xqd_init)
-	linker.DefineFunc("fastly_uap", "parse", i.xqd_uap_parse)
+	i.define(linker, "fastly", "init", i.xqd_init)
+	i.define(linker, "fastly_uap", "parse", i.xqd_uap_parse)
 
-	linker.DefineFunc("env", "xqd_req_body_downstream_get", i.xqd_req_body_downstream_get)
-	linker.DefineFunc("env", "xqd_resp_send_downstream", i.xqd_resp_send_downstream)
-	linker.DefineFunc("env", "xqd_req_downstream_client_ip_addr", i.xqd_req_downstream_client_ip_addr)
+	i.define(linker, "env", "xqd_req_body_downstream_get", i.xqd_req_body_downstream_get)
+	i.define(linker, "env", "xqd_resp_send_downstream", i.xqd_resp_send_downstream)
+	i.define(linker, "env", "xqd_req_downstream_client_ip_addr", i.xqd_req_downstream_client_ip_addr)
+	i.define(linker, "env", "xqd_req_downstream_tls_cipher_openssl_name", i.xqd_req_downstream_tls_cipher_openssl_name)
+	i.define(linker, "env", "xqd_req_downstream_tls_protocol", i.xqd_req_downstream_tls_protocol)
 
 	// xqd_request.go
-	linker.DefineFunc("env", "xqd_req_new", i.xqd_req_new)
-	linker.DefineFunc("env", "xqd_req_version_get", i.xqd_req_version_get)
-	linker.DefineFunc("env", "xqd_req_version_set", i.xqd_req_version_set)
-	linker.DefineFunc("env", "xqd_req_method_get", i.xqd_req_method_get)
-	linker.DefineFunc("env", "xqd_req_method_set", i.xqd_req_method_set)
-	linker.DefineFunc("env", "xqd_req_uri_get", i.xqd_req_uri_get)
-	linker.DefineFunc("env", "xqd_req_uri_set", i.xqd_req_uri_set)
-	linker.DefineFunc("env", "xqd_req_header_remove", i.xqd_req_header_remove)
-	linker.DefineFunc("env", "xqd_req_header_names_get", i.xqd_req_header_names_get)
-	linker.DefineFunc("env", "xqd_req_header_value_get", i.xqd_req_header_value_get)
-	linker.DefineFunc("env", "xqd_req_header_values_get", i.xqd_req_header_values_get)
-	linker.DefineFunc("env", "xqd_req_header_values_set", i.xqd_req_header_values_set)
-	linker.DefineFunc("env", "xqd_req_send", i.xqd_req_send)
-	linker.DefineFunc("env", "xqd_req_cache_override_set", i.xqd_req_cache_override_set)
-	linker.DefineFunc("env", "xqd_req_cache_override_v2_set", i.xqd_req_cache_override_v2_set)
+	i.define(linker, "env", "xqd_req_new", i.xqd_req_new)
+	i.define(linker, "env", "xqd_req_version_get", i.xqd_req_version_get)
+	i.define(linker, "env", "xqd_req_version_set", i.xqd_req_version_set)
+	i.define(linker, "env", "xqd_req_method_get", i.xqd_req_method_get)
+	i.define(linker, "env", "xqd_req_method_set", i.xqd_req_method_set)
+	i.define(linker, "env", "xqd_req_uri_get", i.xqd_req_uri_get)
+	i.define(linker, "env", "xqd_req_uri_set", i.xqd_req_uri_set)
+	i.define(linker, "env", "xqd_req_header_remove", i.xqd_req_header_remove)
+	i.define(linker, "env", "xqd_req_header_names_get", i.xqd_req_header_names_get)
+	i.define(linker, "env", "xqd_req_header_value_get", i.xqd_req_header_value_get)
+	i.define(linker, "env", "xqd_req_header_values_get", i.xqd_req_header_values_get)
+	i.define(linker, "env", "xqd_req_header_values_set", i.xqd_req_header_values_set)
+	i.define(linker, "env", "xqd_req_send", i.xqd_req_send)
+	i.define(linker, "env", "xqd_req_send_async", i.xqd_req_send_async)
+	i.define(linker, "env", "xqd_pending_req_poll", i.xqd_pending_req_poll)
+	i.define(linker, "env", "xqd_pending_req_wait", i.xqd_pending_req_wait)
+	i.define(linker, "env", "xqd_pending_req_select", i.xqd_pending_req_select)
+	i.define(linker, "env", "xqd_req_cache_override_set", i.xqd_req_cache_override_set)
+	i.define(linker, "env", "xqd_req_cache_override_v2_set", i.xqd_req_cache_override_v2_set)
 	// The Go http implementation doesn't make it easy to get at the original headers in order, so
 	// we just use the same sorted order
-	linker.DefineFunc("env", "xqd_req_original_header_names_get", i.xqd_req_header_names_get)
-	linker.DefineFunc("env", "xqd_req_close", i.xqd_req_close)
+	i.define(linker, "env", "xqd_req_original_header_names_get", i.xqd_req_original_header_names_get)
+	i.define(linker, "env", "xqd_req_original_header_count", i.xqd_req_original_header_count)
+	i.define(linker, "env", "xqd_req_close", i.xqd_req_close)
 
 	// xqd_response.go
-	linker.DefineFunc("env", "xqd_resp_new", i.xqd_resp_new)
-	linker.DefineFunc("env", "xqd_resp_status_get", i.xqd_resp_status_get)
-	linker.DefineFunc("env", "xqd_resp_status_set", i.xqd_resp_status_set)
-	linker.DefineFunc("env", "xqd_resp_version_get", i.xqd_resp_version_get)
-	linker.DefineFunc("env", "xqd_resp_version_set", i.xqd_resp_version_set)
-	linker.DefineFunc("env", "xqd_resp_header_remove", i.xqd_resp_header_remove)
-	linker.DefineFunc("env", "xqd_resp_header_names_get", i.xqd_resp_header_names_get)
-	linker.DefineFunc("env", "xqd_resp_header_values_get", i.xqd_resp_header_values_get)
-	linker.DefineFunc("env", "xqd_resp_header_values_set", i.xqd_resp_header_values_set)
-	linker.DefineFunc("env", "xqd_resp_close", i.xqd_resp_close)
+	i.define(linker, "env", "xqd_resp_new", i.xqd_resp_new)
+	i.define(linker, "env", "xqd_resp_status_get", i.xqd_resp_status_get)
+	i.define(linker, "env", "xqd_resp_status_set", i.xqd_resp_status_set)
+	i.define(linker, "env", "xqd_resp_version_get", i.xqd_resp_version_get)
+	i.define(linker, "env", "xqd_resp_version_set", i.xqd_resp_version_set)
+	i.define(linker, "env", "xqd_resp_header_remove", i.xqd_resp_header_remove)
+	i.define(linker, "env", "xqd_resp_header_names_get", i.xqd_resp_header_names_get)
+	i.define(linker, "env", "xqd_resp_header_values_get", i.xqd_resp_header_values_get)
+	i.define(linker, "env", "xqd_resp_header_values_set", i.xqd_resp_header_values_set)
+	i.define(linker, "env", "xqd_resp_close", i.xqd_resp_close)
 
 	// xqd_body.go
-	linker.DefineFunc("env", "xqd_body_new", i.xqd_body_new)
-	linker.DefineFunc("env", "xqd_body_write", i.xqd_body_write)
-	linker.DefineFunc("env", "xqd_body_read", i.xqd_body_read)
-	linker.DefineFunc("env", "xqd_body_append", i.xqd_body_append)
+	i.define(linker, "env", "xqd_body_new", i.xqd_body_new)
+	i.define(linker, "env", "xqd_body_write", i.xqd_body_write)
+	i.define(linker, "env", "xqd_body_read", i.xqd_body_read)
+	i.define(linker, "env", "xqd_body_append", i.xqd_body_append)
 
 	// xqd_log.go
-	linker.DefineFunc("env", "xqd_log_endpoint_get", i.xqd_log_endpoint_get)
-	linker.DefineFunc("env", "xqd_log_write", i.xqd_log_write)
+	i.define(linker, "env", "xqd_log_endpoint_get", i.xqd_log_endpoint_get)
+	i.define(linker, "env", "xqd_log_write", i.xqd_log_write)
 }
@@ -0,0 +1,59 @@
+package fastlike
+
+import (
+	"net/http"
+	"testing"
+)
+
+// helloLegacyWat is helloWat, but built against the legacy ABI
+const helloLegacyWat = `
+(module
+  (import "fastly" "init" (func $init (param i64) (result i32)))
+  (import "env" "xqd_resp_new" (func $resp_new (param i32) (result i32)))
+  (import "env" "xqd_body_new" (func $body_new (param i32) (result i32)))
+  (import "env" "xqd_body_write" (func $body_write (param i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "xqd_resp_send_downstream" (func $send_downstream (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 64) "Hello, world!")
+  (func (export "_start")
+    (drop (call $init (i64.const 1)))
+    (drop (call $resp_new (i32.const 0)))
+    (drop (call $body_new (i32.const 4)))
+    (drop (call $body_write (i32.load (i32.const 4)) (i32.const 64) (i32.const 13) (i32.const 0) (i32.const 8)))
+    (drop (call $send_downstream (i32.load (i32.const 0)) (i32.load (i32.const 4)) (i32.const 0)))))
+`
+
+func TestDetectABI(t *testing.T) {
+	var cases = []struct {
+		name    string
+		src     string
+		abi     abi
+		defined [2]string
+		missing [2]string
+	}{
+		{"modern", helloWat, abiModern, [2]string{"fastly_http_req", "send"}, [2]string{"env", "xqd_req_send"}},
+		{"legacy", helloLegacyWat, abiLegacy, [2]string{"env", "xqd_req_send"}, [2]string{"fastly_http_req", "send"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			i := NewInstance(wat(st, c.src))
+			if i.wasmctx.abi != c.abi {
+				st.Fatalf("expected abi %d, got %d", c.abi, i.wasmctx.abi)
+			}
+
+			if _, err := i.wasmctx.linker.GetOneByName(c.defined[0], c.defined[1]); err != nil {
+				st.Errorf("expected %s::%s to be linked, got %s", c.defined[0], c.defined[1], err)
+			}
+			if _, err := i.wasmctx.linker.GetOneByName(c.missing[0], c.missing[1]); err == nil {
+				st.Errorf("expected %s::%s to not be linked", c.missing[0], c.missing[1])
+			}
+
+			r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+			w := serve(st, c.src, r)
+			if w.Code != http.StatusOK || w.Body.String() != "Hello, world!" {
+				st.Errorf("expected 200 \"Hello, world!\", got %d %q", w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package fastlike
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long a file has to go without changes before it's loaded again. Editors
+// often save a file in several steps, and loading it halfway through would fail.
+const watchDebounce = 100 * time.Millisecond
+
+// watchDictionaries loads every file dictionary again when its file changes on disk. It watches
+// the directories rather than the files themselves, so that editors which save by replacing the
+// file keep being picked up. Files that fail to load keep their old contents and a warning is
+// printed.
+func watchDictionaries(dictionaries []*fileDictionary) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	var files = map[string]*fileDictionary{}
+	for _, d := range dictionaries {
+		name, err := filepath.Abs(d.filename)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+
+		if _, ok := files[name]; ok {
+			continue
+		}
+		files[name] = d
+
+		if err := watcher.Add(filepath.Dir(name)); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		// timers debounces changes per file. A timer that has already fired is simply re-armed.
+		var timers = map[string]*time.Timer{}
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				name, err := filepath.Abs(event.Name)
+				if err != nil {
+					continue
+				}
+
+				var d, watched = files[name]
+				if !watched || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+
+				if t, ok := timers[name]; ok {
+					t.Reset(watchDebounce)
+				} else {
+					timers[name] = time.AfterFunc(watchDebounce, func() {
+						if err := d.load(); err != nil {
+							fmt.Printf("Warning: error reloading %s, got %s\n", d.filename, err.Error())
+							return
+						}
+						fmt.Printf("Reloaded %s\n", d.filename)
+					})
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Printf("Warning: error watching dictionary files, got %s\n", err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
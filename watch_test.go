@@ -0,0 +1,65 @@
+package fastlike
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfigFiles(t *testing.T) {
+	var filename = filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(filename, []byte(`{"color": "red"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newTestFastlike(t, helloWat, WithDictionaryFile("config", filename), WithWatchConfigFiles())
+
+	var lookup = func() string {
+		i := f.Instantiate()
+		defer f.put(i, true)
+		v, _ := i.getDictionary(i.getDictionaryHandle("config"))("color")
+		return v
+	}
+
+	var await = func(want string) {
+		t.Helper()
+		var deadline = time.Now().Add(5 * time.Second)
+		for lookup() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected color %q, got %q", want, lookup())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if got := lookup(); got != "red" {
+		t.Fatalf("expected color red, got %q", got)
+	}
+
+	// Rewriting the file in place is picked up
+	if err := ioutil.WriteFile(filename, []byte(`{"color": "green"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	await("green")
+
+	// So is replacing it, the way many editors save
+	var tmp = filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(`{"color": "blue"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		t.Fatal(err)
+	}
+	await("blue")
+
+	// A broken file keeps the old contents
+	if err := ioutil.WriteFile(filename, []byte(`{"color": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * watchDebounce)
+	if got := lookup(); got != "blue" {
+		t.Fatalf("expected a broken file to keep color blue, got %q", got)
+	}
+}
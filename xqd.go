@@ -1,14 +1,24 @@
 package fastlike
 
 import (
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go"
 )
 
+// xqd_init is called by the guest with the ABI version it was built against. In abi.rs, init only
+// takes the version and returns a status; there's no way to report which features the host
+// supports, so guests find out by calling a method and checking for XqdErrUnsupported.
 func (i *Instance) xqd_init(abiv int64) int32 {
 	i.abilog.Printf("init: version=%d\n", abiv)
 	if abiv != 1 {
@@ -33,13 +43,15 @@ func (i *Instance) xqd_req_body_downstream_get(request_handle_out int32, body_ha
 		rh.Request.URL.Scheme = "http"
 	}
 
-	// NOTE: Originally, we setup the body handle using `bodies.NewReader(rh.Body)`, but there is
-	// a bug when the *new* request (rh) is sent via subrequest where the subrequest target doesn't
-	// get the body. I don't know why. This "solves" the problem for fastlike, at least
-	// temporarily.
-	var bhid, bh = i.bodies.NewBuffer()
-	io.Copy(bh, i.ds_request.Body)
-	i.ds_request.Body.Close()
+	// The body is read straight from the client. Its length is only known if the client sent a
+	// Content-Length; chunked bodies report -1. The body is closed when the instance is reset.
+	// Requests built in-process can have no body at all, which is the same as an empty one.
+	var body, length = i.ds_request.Body, i.ds_request.ContentLength
+	if body == nil {
+		body, length = http.NoBody, 0
+	}
+	var bhid, bh = i.bodies.NewReader(body)
+	bh.length = length
 
 	i.memory.PutUint32(uint32(rhid), int64(request_handle_out))
 	i.memory.PutUint32(uint32(bhid), int64(body_handle_out))
@@ -50,11 +62,6 @@ func (i *Instance) xqd_req_body_downstream_get(request_handle_out int32, body_ha
 }
 
 func (i *Instance) xqd_resp_send_downstream(whandle int32, bhandle int32, stream int32) int32 {
-	if stream != 0 {
-		i.abilog.Printf("resp_send_downstream: streaming unsupported")
-		return XqdErrUnsupported
-	}
-
 	var w, b = i.responses.Get(int(whandle)), i.bodies.Get(int(bhandle))
 	if w == nil {
 		i.abilog.Printf("resp_send_downstream: invalid response handle %d", whandle)
@@ -63,26 +70,122 @@ func (i *Instance) xqd_resp_send_downstream(whandle int32, bhandle int32, stream
 		i.abilog.Printf("resp_send_downstream: invalid body handle %d", bhandle)
 		return XqdErrInvalidHandle
 	}
-	defer b.Close()
 
 	for k, v := range w.Header {
 		i.ds_response.Header()[k] = v
 	}
 
+	// Framing comes from the body rather than the guest, so bodies of known length get a matching
+	// Content-Length instead of being sent chunked. Streamed bodies can keep growing, so they're
+	// always sent without one.
+	i.ds_response.Header().Del("content-length")
+	i.ds_response.Header().Del("transfer-encoding")
+
+	// When enabled, bodies are gzipped for clients that accept it, unless the program already
+	// encoded them. The compressed length isn't known up front, so they're sent without a
+	// Content-Length.
+	var compress = i.compressDownstream && bodyAllowed(w.StatusCode) &&
+		w.Header.Get("content-encoding") == "" && acceptsGzip(i.ds_request)
+	if compress {
+		i.ds_response.Header().Set("content-encoding", "gzip")
+		i.ds_response.Header().Add("vary", "Accept-Encoding")
+	}
+
+	if stream == 0 && !compress && b.Size() >= 0 && bodyAllowed(w.StatusCode) {
+		i.ds_response.Header().Set("content-length", strconv.FormatInt(b.Size(), 10))
+	}
+
 	i.ds_response.WriteHeader(w.StatusCode)
 
-	_, err := io.Copy(i.ds_response, b)
+	// Responses to HEAD requests keep the Content-Length of the body they would have had, but not
+	// the body itself
+	var out io.Writer = i.ds_response
+	if i.ds_request.Method == http.MethodHead {
+		out = ioutil.Discard
+	}
+
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(out)
+		out = gz
+	}
+
+	if stream != 0 {
+		out = flushWriter{out, i.ds_response}
+	}
+
+	_, err := io.Copy(out, b)
+	b.Close()
+	if err == nil && gz != nil && stream == 0 {
+		err = gz.Close()
+	}
 	if err != nil {
 		i.abilog.Printf("resp_send_downstream: copy err, got %s", err.Error())
 		return XqdError
 	}
 
+	// A streamed body stays open, and everything the guest writes to it from now on goes straight
+	// to the client. A compressed one is finished off when it's closed.
+	if stream != 0 {
+		b.reader, b.writer, b.closer, b.buf = nil, out, nil, nil
+		if gz != nil {
+			b.closer = gz
+		}
+		if f, ok := i.ds_response.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
 	return XqdStatusOK
 }
 
-func (i *Instance) xqd_req_downstream_client_ip_addr(octets_out int32, nwritten_out int32) int32 {
+// flushWriter is an io.Writer which flushes every write to w through to rw, including anything a
+// gzip.Writer in between is holding on to
+type flushWriter struct {
+	w  io.Writer
+	rw http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if gz, ok := fw.w.(*gzip.Writer); ok && err == nil {
+		err = gz.Flush()
+	}
+	if f, ok := fw.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// acceptsGzip reports whether the Accept-Encoding of r allows a gzipped response
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("accept-encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			var params = strings.Split(enc, ";")
+			var name = strings.ToLower(strings.TrimSpace(params[0]))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+
+			var q = 1.0
+			for _, p := range params[1:] {
+				if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+					q, _ = strconv.ParseFloat(p[2:], 64)
+				}
+			}
+			return q > 0
+		}
+	}
+	return false
+}
 
-	var ip = net.ParseIP(strings.SplitN(i.ds_request.RemoteAddr, ":", 2)[0])
+// bodyAllowed reports whether a response with the given status can have a body
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+func (i *Instance) xqd_req_downstream_client_ip_addr(octets_out int32, nwritten_out int32) int32 {
+	var ip = i.clientIP(i.ds_request)
 	i.abilog.Printf("req_downstream_client_ip_addr: remoteaddr=%s, ip=%q\n", i.ds_request.RemoteAddr, ip)
 
 	// If there's no good IP on the incoming request, we can exit early
@@ -91,7 +194,12 @@ func (i *Instance) xqd_req_downstream_client_ip_addr(octets_out int32, nwritten_
 	}
 
 	// Otherwise, we can just write it to memory. net.IP is implemented a byte slice, which we can
-	// write directly out
+	// write directly out, but IPv4 addresses are usually held in their 16 byte form and the guest
+	// expects 4 octets for them
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
 	nwritten, err := i.memory.WriteAt(ip, int64(octets_out))
 	if err != nil {
 		return XqdError
@@ -102,6 +210,79 @@ func (i *Instance) xqd_req_downstream_client_ip_addr(octets_out int32, nwritten_
 	return XqdStatusOK
 }
 
+// originalHeaderNames returns the names of the headers on the downstream request as they were
+// received, once per value so that repeated headers are counted. net/http doesn't keep the order or
+// casing from the wire, so names are canonicalized and sorted.
+func (i *Instance) originalHeaderNames() []string {
+	var names = []string{}
+	for n, values := range i.ds_request.Header {
+		for range values {
+			names = append(names, n)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func (i *Instance) xqd_req_original_header_names_get(addr int32, maxlen int32, cursor int32, ending_cursor_out int32, nwritten_out int32) int32 {
+	i.abilog.Printf("req_original_header_names_get: cursor=%d", cursor)
+
+	return xqd_multivalue(i.memory, i.originalHeaderNames(), addr, maxlen, cursor, ending_cursor_out, nwritten_out)
+}
+
+func (i *Instance) xqd_req_original_header_count(count_out int32) int32 {
+	var count = len(i.originalHeaderNames())
+	i.abilog.Printf("req_original_header_count: count=%d", count)
+
+	i.memory.PutUint32(uint32(count), int64(count_out))
+
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_req_downstream_tls_cipher_openssl_name(cipher_out int32, cipher_maxlen int32, nwritten_out int32) int32 {
+	var cs = tlsState(i.ds_request)
+	if cs == nil {
+		i.abilog.Printf("req_downstream_tls_cipher_openssl_name: no tls state")
+		return XqdErrNone
+	}
+
+	var cipher = tlsCipherName(cs.CipherSuite)
+	i.abilog.Printf("req_downstream_tls_cipher_openssl_name: cipher=%s", cipher)
+
+	return i.writeDownstreamTLSValue(cipher, cipher_out, cipher_maxlen, nwritten_out)
+}
+
+func (i *Instance) xqd_req_downstream_tls_protocol(protocol_out int32, protocol_maxlen int32, nwritten_out int32) int32 {
+	var cs = tlsState(i.ds_request)
+	if cs == nil {
+		i.abilog.Printf("req_downstream_tls_protocol: no tls state")
+		return XqdErrNone
+	}
+
+	var protocol = tlsProtocolName(cs.Version)
+	i.abilog.Printf("req_downstream_tls_protocol: protocol=%s", protocol)
+
+	return i.writeDownstreamTLSValue(protocol, protocol_out, protocol_maxlen, nwritten_out)
+}
+
+// writeDownstreamTLSValue writes a string value for one of the downstream tls methods, following
+// the usual buffer length protocol
+func (i *Instance) writeDownstreamTLSValue(value string, addr int32, maxlen int32, nwritten_out int32) int32 {
+	if int(maxlen) < len(value) {
+		i.memory.PutUint32(uint32(len(value)), int64(nwritten_out))
+		return XqdErrBufferLength
+	}
+
+	nwritten, err := i.memory.WriteAt([]byte(value), int64(addr))
+	if err != nil {
+		return XqdError
+	}
+
+	i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
+	return XqdStatusOK
+}
+
 func (i *Instance) xqd_uap_parse(
 	addr int32, size int32,
 	family_out, family_maxlen, family_nwritten_out int32,
@@ -121,6 +302,17 @@ func (i *Instance) xqd_uap_parse(
 
 	var ua = i.uaparser(useragent)
 
+	// If any of the buffers are too small, write out the required size of every field so the
+	// guest can retry with large enough buffers
+	if int(family_maxlen) < len(ua.Family) || int(major_maxlen) < len(ua.Major) ||
+		int(minor_maxlen) < len(ua.Minor) || int(patch_maxlen) < len(ua.Patch) {
+		i.memory.PutUint32(uint32(len(ua.Family)), int64(family_nwritten_out))
+		i.memory.PutUint32(uint32(len(ua.Major)), int64(major_nwritten_out))
+		i.memory.PutUint32(uint32(len(ua.Minor)), int64(minor_nwritten_out))
+		i.memory.PutUint32(uint32(len(ua.Patch)), int64(patch_nwritten_out))
+		return XqdErrBufferLength
+	}
+
 	family_nwritten, err := i.memory.WriteAt([]byte(ua.Family), int64(family_out))
 	if err != nil {
 		i.abilog.Printf("uap_parse: family write err, got %s", err.Error())
@@ -161,65 +353,70 @@ func p(l *log.Logger, name string, args ...int32) {
 	l.Printf("[STUB] %s: args=%q\n", name, xs)
 }
 
-func (i *Instance) wasm0(name string) func() int32 {
-	return func() int32 {
-		p(i.abilog, name)
-		return 5
+// stub is called by the stubbed XQD methods. By default, the call is logged to the abi log and the
+// guest gets XqdErrUnsupported back. With WithStrictABI, the guest is trapped instead, so it's
+// obvious which method needs an implementation.
+func (i *Instance) stub(name string, args ...int32) (int32, *wasmtime.Trap) {
+	if !i.strictABI {
+		p(i.abilog, name, args...)
+		return XqdErrUnsupported, nil
+	}
+
+	var msg = fmt.Sprintf("unimplemented XQD method %s called with args=%v", name, args)
+	fmt.Fprintf(os.Stderr, "[fastlike] %s\n", msg)
+	return XqdErrUnsupported, wasmtime.NewTrap(i.wasmctx.store, msg)
+}
+
+func (i *Instance) wasm0(name string) func() (int32, *wasmtime.Trap) {
+	return func() (int32, *wasmtime.Trap) {
+		return i.stub(name)
 	}
 }
 
-func (i *Instance) wasm1(name string) func(a int32) int32 {
-	return func(a int32) int32 {
-		p(i.abilog, name, a)
-		return 5
+func (i *Instance) wasm1(name string) func(a int32) (int32, *wasmtime.Trap) {
+	return func(a int32) (int32, *wasmtime.Trap) {
+		return i.stub(name, a)
 	}
 }
 
-func (i *Instance) wasm2(name string) func(a, b int32) int32 {
-	return func(a, b int32) int32 {
-		p(i.abilog, name, a, b)
-		return 5
+func (i *Instance) wasm2(name string) func(a, b int32) (int32, *wasmtime.Trap) {
+	return func(a, b int32) (int32, *wasmtime.Trap) {
+		return i.stub(name, a, b)
 	}
 }
 
-func (i *Instance) wasm3(name string) func(a, b, c int32) int32 {
-	return func(a, b, c int32) int32 {
-		p(i.abilog, name, a, b, c)
-		return 5
+func (i *Instance) wasm3(name string) func(a, b, c int32) (int32, *wasmtime.Trap) {
+	return func(a, b, c int32) (int32, *wasmtime.Trap) {
+		return i.stub(name, a, b, c)
 	}
 }
 
-func (i *Instance) wasm4(name string) func(a, b, c, d int32) int32 {
-	return func(a, b, c, d int32) int32 {
-		p(i.abilog, name, a, b, c, d)
-		return 5
+func (i *Instance) wasm4(name string) func(a, b, c, d int32) (int32, *wasmtime.Trap) {
+	return func(a, b, c, d int32) (int32, *wasmtime.Trap) {
+		return i.stub(name, a, b, c, d)
 	}
 }
 
-func (i *Instance) wasm5(name string) func(a, b, c, d, e int32) int32 {
-	return func(a, b, c, d, e int32) int32 {
-		p(i.abilog, name, a, b, c, d, e)
-		return 5
+func (i *Instance) wasm5(name string) func(a, b, c, d, e int32) (int32, *wasmtime.Trap) {
+	return func(a, b, c, d, e int32) (int32, *wasmtime.Trap) {
+		return i.stub(name, a, b, c, d, e)
 	}
 }
 
-func (i *Instance) wasm6(name string) func(a, b, c, d, e, f int32) int32 {
-	return func(a, b, c, d, e, f int32) int32 {
-		p(i.abilog, name, a, b, c, d, e, f)
-		return 5
+func (i *Instance) wasm6(name string) func(a, b, c, d, e, f int32) (int32, *wasmtime.Trap) {
+	return func(a, b, c, d, e, f int32) (int32, *wasmtime.Trap) {
+		return i.stub(name, a, b, c, d, e, f)
 	}
 }
 
-func (i *Instance) wasm7(name string) func(a, b, c, d, e, f, g int32) int32 {
-	return func(a, b, c, d, e, f, g int32) int32 {
-		p(i.abilog, name, a, b, c, d, e, f, g)
-		return 5
+func (i *Instance) wasm7(name string) func(a, b, c, d, e, f, g int32) (int32, *wasmtime.Trap) {
+	return func(a, b, c, d, e, f, g int32) (int32, *wasmtime.Trap) {
+		return i.stub(name, a, b, c, d, e, f, g)
 	}
 }
 
-func (i *Instance) wasm8(name string) func(a, b, c, d, e, f, g, h int32) int32 {
-	return func(a, b, c, d, e, f, g, h int32) int32 {
-		p(i.abilog, name, a, b, c, d, e, f, g, h)
-		return 5
+func (i *Instance) wasm8(name string) func(a, b, c, d, e, f, g, h int32) (int32, *wasmtime.Trap) {
+	return func(a, b, c, d, e, f, g, h int32) (int32, *wasmtime.Trap) {
+		return i.stub(name, a, b, c, d, e, f, g, h)
 	}
 }
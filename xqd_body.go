@@ -13,8 +13,7 @@ func (i *Instance) xqd_body_new(handle_out int32) int32 {
 }
 
 func (i *Instance) xqd_body_write(handle int32, addr int32, size int32, body_end int32, nwritten_out int32) int32 {
-	// TODO: Figure out what we're supposed to do with `body_end` which can be 0 (back) or
-	// 1 (front)
+	// `body_end` selects which end of the body to write to, which can be 0 (back) or 1 (front)
 	i.abilog.Printf("body_write: handle=%d size=%d, body_end=%d", handle, size, body_end)
 
 	var body = i.bodies.Get(int(handle))
@@ -22,6 +21,30 @@ func (i *Instance) xqd_body_write(handle int32, addr int32, size int32, body_end
 		return XqdErrInvalidHandle
 	}
 
+	if i.maxBodySize > 0 && body.accumulated+int64(size) > i.maxBodySize {
+		i.abilog.Printf("body_write: body would exceed the maximum size of %d bytes", i.maxBodySize)
+		return XqdError
+	}
+
+	if body_end == BodyWriteEndFront {
+		var buf = make([]byte, size)
+		_, err := i.memory.ReadAt(buf, int64(addr))
+		if err != nil {
+			return XqdError
+		}
+
+		nwritten, err := body.Prepend(buf)
+		if err != nil {
+			i.abilog.Printf("body_write: prepend error, got=%s", err.Error())
+			return XqdErrUnsupported
+		}
+
+		i.usage.BodyBytesWritten += int64(nwritten)
+
+		i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
+		return XqdStatusOK
+	}
+
 	// Copy size bytes starting at addr into the body handle
 	nwritten, err := io.CopyN(body, bytes.NewReader(i.memory.Data()[addr:]), int64(size))
 	if err != nil {
@@ -30,6 +53,8 @@ func (i *Instance) xqd_body_write(handle int32, addr int32, size int32, body_end
 		return XqdError
 	}
 
+	i.usage.BodyBytesWritten += nwritten
+
 	// Write out how many bytes we copied
 	i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
 
@@ -42,26 +67,35 @@ func (i *Instance) xqd_body_read(handle int32, addr int32, maxlen int32, nread_o
 		return XqdErrInvalidHandle
 	}
 
-	var buf = bytes.NewBuffer(make([]byte, 0, maxlen))
-	var ncopied, err = io.Copy(buf, io.LimitReader(body, int64(maxlen)))
-	if err != nil {
+	// Hand back whatever a single read produces instead of waiting for maxlen bytes, so streamed
+	// bodies reach the guest as they arrive. Reading nothing means the body is done, so reads which
+	// make no progress without an error are retried.
+	var buf = make([]byte, maxlen)
+	var ncopied int
+	var err error
+	for ncopied == 0 && err == nil && maxlen > 0 {
+		ncopied, err = body.Read(buf)
+	}
+	if err != nil && err != io.EOF {
 		i.abilog.Printf("body_read: error copying got=%s", err.Error())
 		return XqdError
 	}
 
-	var nwritten, err2 = i.memory.WriteAt(buf.Bytes(), int64(addr))
+	var nwritten, err2 = i.memory.WriteAt(buf[:ncopied], int64(addr))
 	if err2 != nil {
 		i.abilog.Printf("body_read: error writing got=%s", err2.Error())
 		return XqdError
 	}
 
-	if ncopied != int64(nwritten) {
+	if ncopied != nwritten {
 		i.abilog.Printf("body_read: error copying copied=%d wrote=%d", ncopied, nwritten)
 		return XqdError
 	}
 
 	i.abilog.Printf("body_read: handle=%d copied=%d", handle, ncopied)
 
+	i.usage.BodyBytesRead += int64(ncopied)
+
 	// Write out how many bytes we copied
 	i.memory.PutUint32(uint32(nwritten), int64(nread_out))
 
@@ -81,9 +115,20 @@ func (i *Instance) xqd_body_append(dst_handle int32, src_handle int32) int32 {
 		return XqdErrInvalidHandle
 	}
 
-	// replace the destination reader with a multireader that reads first from the original reader
-	// and then from the source
-	dst.reader = io.MultiReader(dst.reader, src)
+	if dst == src {
+		i.abilog.Printf("body_append: cannot append a body to itself")
+		return XqdErrInvalidArgument
+	}
+
+	if i.maxBodySize > 0 && dst.accumulated+src.appendedSize() > i.maxBodySize {
+		i.abilog.Printf("body_append: body would exceed the maximum size of %d bytes", i.maxBodySize)
+		return XqdError
+	}
+
+	if err := dst.Append(src); err != nil {
+		i.abilog.Printf("body_append: %s", err)
+		return XqdError
+	}
 
 	return XqdStatusOK
 }
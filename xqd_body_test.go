@@ -0,0 +1,323 @@
+package fastlike
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBodyWriteEnd(t *testing.T) {
+	i := newTestInstance(t)
+
+	bhid, _ := i.bodies.NewBuffer()
+	i.memory.WriteAt([]byte("world!"), 100)
+	i.memory.WriteAt([]byte("Hello, "), 200)
+
+	if s := i.xqd_body_write(int32(bhid), 100, 6, BodyWriteEndBack, 0); s != XqdStatusOK {
+		t.Fatalf("back write: expected status %d, got %d", XqdStatusOK, s)
+	}
+	if s := i.xqd_body_write(int32(bhid), 200, 7, BodyWriteEndFront, 0); s != XqdStatusOK {
+		t.Fatalf("front write: expected status %d, got %d", XqdStatusOK, s)
+	}
+	if n := i.memory.Uint32(0); n != 7 {
+		t.Errorf("front write: expected nwritten 7, got %d", n)
+	}
+
+	if s := i.xqd_body_read(int32(bhid), 300, 64, 0); s != XqdStatusOK {
+		t.Fatalf("read: expected status %d, got %d", XqdStatusOK, s)
+	}
+	n := i.memory.Uint32(0)
+	if actual := string(i.memory.Data()[300 : 300+n]); actual != "Hello, world!" {
+		t.Errorf("expected %q, got %q", "Hello, world!", actual)
+	}
+}
+
+func TestBodyWriteFrontUnbuffered(t *testing.T) {
+	i := newTestInstance(t)
+
+	bhid, _ := i.bodies.NewWriter(ioutil.Discard)
+	i.memory.WriteAt([]byte("front"), 100)
+	if s := i.xqd_body_write(int32(bhid), 100, 5, BodyWriteEndFront, 0); s != XqdErrUnsupported {
+		t.Errorf("expected status %d, got %d", XqdErrUnsupported, s)
+	}
+}
+
+func TestBodyAppendLength(t *testing.T) {
+	i := newTestInstance(t)
+
+	dst, dh := i.bodies.NewBuffer()
+	src, sh := i.bodies.NewBuffer()
+	dh.Write([]byte("Hello, "))
+	sh.Write([]byte("world!"))
+
+	if s := i.xqd_body_append(int32(dst), int32(src)); s != XqdStatusOK {
+		t.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+	}
+	if size := dh.Size(); size != 13 {
+		t.Errorf("expected appended body length 13, got %d", size)
+	}
+
+	// Appending a body of unknown length makes the result unknown too
+	unknown, _ := i.bodies.NewReader(ioutil.NopCloser(strings.NewReader("?")))
+	i.xqd_body_append(int32(dst), int32(unknown))
+	if size := dh.Size(); size != -1 {
+		t.Errorf("expected unknown body length -1, got %d", size)
+	}
+}
+
+// trackedReader is a body that remembers being closed
+type trackedReader struct {
+	io.Reader
+	closed bool
+}
+
+func (r *trackedReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestBodyAppend(t *testing.T) {
+	type body func(i *Instance, content string) (int, *trackedReader)
+
+	var buffer body = func(i *Instance, content string) (int, *trackedReader) {
+		id, b := i.bodies.NewBuffer()
+		b.Write([]byte(content))
+		return id, nil
+	}
+	var reader body = func(i *Instance, content string) (int, *trackedReader) {
+		r := &trackedReader{Reader: strings.NewReader(content)}
+		id, _ := i.bodies.NewReader(r)
+		return id, r
+	}
+	var appended body = func(i *Instance, content string) (int, *trackedReader) {
+		id, _ := buffer(i, content[:2])
+		rest, r := reader(i, content[2:])
+		i.xqd_body_append(int32(id), int32(rest))
+		return id, r
+	}
+
+	var cases = []struct {
+		name     string
+		dst, src body
+	}{
+		{"buffer+buffer", buffer, buffer},
+		{"buffer+reader", buffer, reader},
+		{"reader+buffer", reader, buffer},
+		{"reader+reader", reader, reader},
+		{"appended+buffer", appended, buffer},
+		{"buffer+appended", buffer, appended},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			i := newTestInstance(st)
+			dst, dr := c.dst(i, "Hello, ")
+			src, sr := c.src(i, "world")
+
+			if s := i.xqd_body_append(int32(dst), int32(src)); s != XqdStatusOK {
+				st.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+			}
+
+			// Writes after an append go after the appended body
+			i.memory.WriteAt([]byte("!"), 100)
+			if s := i.xqd_body_write(int32(dst), 100, 1, BodyWriteEndBack, 0); s != XqdStatusOK {
+				st.Fatalf("write: expected status %d, got %d", XqdStatusOK, s)
+			}
+
+			var b = i.bodies.Get(dst)
+			if body, _ := ioutil.ReadAll(b); string(body) != "Hello, world!" {
+				st.Errorf("expected %q, got %q", "Hello, world!", body)
+			}
+
+			b.Close()
+			for _, r := range []*trackedReader{dr, sr} {
+				if r != nil && !r.closed {
+					st.Error("expected closing the destination to close every body it's made of")
+				}
+			}
+		})
+	}
+
+	t.Run("writer", func(st *testing.T) {
+		i := newTestInstance(st)
+		var w bytes.Buffer
+		dst, _ := i.bodies.NewWriter(&w)
+		src, _ := reader(i, "Hello, world!")
+
+		if s := i.xqd_body_append(int32(dst), int32(src)); s != XqdStatusOK {
+			st.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+		}
+		if w.String() != "Hello, world!" {
+			st.Errorf("expected the source to be copied to the writer, got %q", w.String())
+		}
+	})
+
+	t.Run("backend", func(st *testing.T) {
+		i := newTestInstance(st, WithBackend("backend", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("world!"))
+		})))
+		_, src := send(st, i, "backend")
+		dst, _ := buffer(i, "Hello, ")
+
+		if s := i.xqd_body_append(int32(dst), int32(src)); s != XqdStatusOK {
+			st.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+		}
+		if body, _ := ioutil.ReadAll(i.bodies.Get(dst)); string(body) != "Hello, world!" {
+			st.Errorf("expected %q, got %q", "Hello, world!", body)
+		}
+	})
+
+	t.Run("self", func(st *testing.T) {
+		i := newTestInstance(st)
+		id, _ := buffer(i, "Hello")
+		if s := i.xqd_body_append(int32(id), int32(id)); s != XqdErrInvalidArgument {
+			st.Errorf("expected status %d, got %d", XqdErrInvalidArgument, s)
+		}
+	})
+}
+
+func TestBodyReadStreaming(t *testing.T) {
+	// The backend sends a few bytes and then holds the rest back until they've been read
+	var release = make(chan struct{})
+	i := newTestInstance(t, WithBackend("backend", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(", world"))
+	})))
+	defer close(release)
+
+	var read = make(chan string, 1)
+	go func() {
+		_, bhid := send(t, i, "backend")
+		if s := i.xqd_body_read(int32(bhid), 1024, 8192, 208); s != XqdStatusOK {
+			read <- fmt.Sprintf("status %d", s)
+			return
+		}
+		var got = make([]byte, i.memory.Uint32(208))
+		i.memory.ReadAt(got, 1024)
+		read <- string(got)
+	}()
+
+	select {
+	case got := <-read:
+		if got != "hello" {
+			t.Errorf("expected to read %q, got %q", "hello", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the bytes the backend flushed")
+	}
+}
+
+func TestBodyReadLength(t *testing.T) {
+	i := newTestInstance(t)
+
+	bh, b := i.bodies.NewBuffer()
+	b.Write([]byte("Hello, world!"))
+
+	// Reading part of the body leaves the rest to be sent, so the size shrinks with it
+	if s := i.xqd_body_read(int32(bh), 100, 7, 200); s != XqdStatusOK {
+		t.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+	}
+	if size := b.Size(); size != 6 {
+		t.Errorf("expected 6 bytes left after reading 7, got %d", size)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	t.Run("write", func(st *testing.T) {
+		i := newTestInstance(st, WithMaxBodySize(8))
+		bhid, _ := i.bodies.NewBuffer()
+		i.memory.WriteAt([]byte("Hello, world!"), 100)
+
+		if s := i.xqd_body_write(int32(bhid), 100, 5, BodyWriteEndBack, 0); s != XqdStatusOK {
+			st.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+		}
+		if s := i.xqd_body_write(int32(bhid), 100, 5, BodyWriteEndBack, 0); s != XqdError {
+			st.Errorf("back write: expected status %d past the cap, got %d", XqdError, s)
+		}
+		if s := i.xqd_body_write(int32(bhid), 100, 5, BodyWriteEndFront, 0); s != XqdError {
+			st.Errorf("front write: expected status %d past the cap, got %d", XqdError, s)
+		}
+		if s := i.xqd_body_write(int32(bhid), 100, 3, BodyWriteEndBack, 0); s != XqdStatusOK {
+			st.Errorf("expected a write up to the cap to succeed, got %d", s)
+		}
+	})
+
+	t.Run("append", func(st *testing.T) {
+		i := newTestInstance(st, WithMaxBodySize(8))
+		dst, dh := i.bodies.NewBuffer()
+		src, sh := i.bodies.NewBuffer()
+		dh.Write([]byte("Hello, "))
+		sh.Write([]byte("world!"))
+
+		if s := i.xqd_body_append(int32(dst), int32(src)); s != XqdError {
+			st.Errorf("expected status %d past the cap, got %d", XqdError, s)
+		}
+	})
+
+	// Appending a body that isn't backed by a buffer doesn't start the count over
+	t.Run("write, append, write", func(st *testing.T) {
+		i := newTestInstance(st, WithMaxBodySize(8))
+		dst, _ := i.bodies.NewBuffer()
+		src, _ := i.bodies.NewReader(ioutil.NopCloser(strings.NewReader("")))
+		i.memory.WriteAt([]byte("Hello"), 100)
+
+		if s := i.xqd_body_write(int32(dst), 100, 5, BodyWriteEndBack, 0); s != XqdStatusOK {
+			st.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+		}
+		if s := i.xqd_body_append(int32(dst), int32(src)); s != XqdStatusOK {
+			st.Fatalf("append: expected status %d, got %d", XqdStatusOK, s)
+		}
+		if s := i.xqd_body_write(int32(dst), 100, 5, BodyWriteEndBack, 0); s != XqdError {
+			st.Errorf("expected status %d past the cap after an append, got %d", XqdError, s)
+		}
+	})
+
+	t.Run("append known length", func(st *testing.T) {
+		i := newTestInstance(st, WithMaxBodySize(8))
+		dst, dh := i.bodies.NewBuffer()
+		src, sh := i.bodies.NewReader(ioutil.NopCloser(strings.NewReader("world!")))
+		dh.Write([]byte("Hello, "))
+		sh.length = 6
+
+		if s := i.xqd_body_append(int32(dst), int32(src)); s != XqdError {
+			st.Errorf("expected status %d past the cap, got %d", XqdError, s)
+		}
+	})
+
+	var cases = []struct {
+		name   string
+		body   string
+		status int32
+	}{
+		{"backend under cap", "Hello", XqdStatusOK},
+		{"backend at cap", "Hello, w", XqdStatusOK},
+		{"backend over cap", "Hello, world!", XqdError},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			i := newTestInstance(st, WithMaxBodySize(8), WithBackend("backend", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(c.body))
+			})))
+			_, bhid := send(st, i, "backend")
+
+			var status int32
+			for {
+				status = i.xqd_body_read(int32(bhid), 1024, 64, 208)
+				if status != XqdStatusOK || i.memory.Uint32(208) == 0 {
+					break
+				}
+			}
+			if status != c.status {
+				st.Errorf("body_read: expected status %d, got %d", c.status, status)
+			}
+		})
+	}
+}
@@ -16,6 +16,15 @@ func (i *Instance) xqd_dictionary_open(name_addr int32, name_size int32, addr in
 
 	i.memory.PutUint32(uint32(handle), int64(addr))
 
+	// The guest SDK treats these the same way it does for Fastly: an empty name is XqdErrNone,
+	// and a dictionary that doesn't exist is XqdErrInvalidHandle
+	if name == "" {
+		return XqdErrNone
+	}
+	if handle == HandleInvalid {
+		return XqdErrInvalidHandle
+	}
+
 	return XqdStatusOK
 }
 
@@ -36,7 +45,16 @@ func (i *Instance) xqd_dictionary_get(handle int32, key_addr int32, key_size int
 
 	i.abilog.Printf("dictionary_get: handle=%d key=%s", handle, key)
 
-	var value = lookup(key)
+	var value, ok = lookup(key)
+	if !ok {
+		i.memory.PutUint32(0, int64(nwritten_out))
+		return XqdErrNone
+	}
+
+	if int(size) < len(value) {
+		i.memory.PutUint32(uint32(len(value)), int64(nwritten_out))
+		return XqdErrBufferLength
+	}
 
 	nwritten, err := i.memory.WriteAt([]byte(value), int64(addr))
 	if err != nil {
@@ -0,0 +1,81 @@
+package fastlike
+
+import (
+	"testing"
+)
+
+func TestDictionaryOpen(t *testing.T) {
+	i := newTestInstance(t, WithDictionary("config", func(key string) string { return "value" }))
+
+	var cases = []struct {
+		name   string
+		status int32
+	}{
+		{"config", XqdStatusOK},
+		{"missing", XqdErrInvalidHandle},
+		{"", XqdErrNone},
+	}
+
+	for _, c := range cases {
+		i.memory.WriteAt([]byte(c.name), 100)
+		if s := i.xqd_dictionary_open(100, int32(len(c.name)), 200); s != c.status {
+			t.Errorf("%q: expected status %d, got %d", c.name, c.status, s)
+		}
+
+		// Using the handle of a dictionary that failed to open is an error, not a crash
+		if c.status != XqdStatusOK {
+			var handle = int32(i.memory.Uint32(200))
+			if s := i.xqd_dictionary_get(handle, 100, 1, 300, 64, 400); s != XqdErrInvalidHandle {
+				t.Errorf("%q: expected get with handle %d to fail with %d, got %d", c.name, handle, XqdErrInvalidHandle, s)
+			}
+		}
+	}
+}
+
+func TestDictionaryGetMissing(t *testing.T) {
+	var entries = map[string]string{"empty": "", "color": "red"}
+
+	var cases = []struct {
+		name   string
+		option Option
+		empty  int32
+	}{
+		// The string-returning lookup can't tell an empty value apart from a missing key
+		{"WithDictionary", WithDictionary("config", func(key string) string { return entries[key] }), XqdErrNone},
+		{"WithDictionaryLookup", WithDictionaryLookup("config", func(key string) (string, bool) {
+			v, ok := entries[key]
+			return v, ok
+		}), XqdStatusOK},
+	}
+
+	for _, c := range cases {
+		i := newTestInstance(t, c.option)
+		i.memory.WriteAt([]byte("config"), 100)
+		i.xqd_dictionary_open(100, 6, 200)
+		var handle = int32(i.memory.Uint32(200))
+
+		var keys = []struct {
+			key    string
+			status int32
+			value  string
+		}{
+			{"color", XqdStatusOK, "red"},
+			{"empty", c.empty, ""},
+			{"missing", XqdErrNone, ""},
+		}
+
+		for _, k := range keys {
+			i.memory.WriteAt([]byte(k.key), 100)
+			i.memory.PutUint32(99, 400)
+			if s := i.xqd_dictionary_get(handle, 100, int32(len(k.key)), 300, 64, 400); s != k.status {
+				t.Errorf("%s: %q: expected status %d, got %d", c.name, k.key, k.status, s)
+			}
+
+			var buf = make([]byte, i.memory.Uint32(400))
+			i.memory.ReadAt(buf, 300)
+			if string(buf) != k.value {
+				t.Errorf("%s: %q: expected value %q, got %q", c.name, k.key, k.value, buf)
+			}
+		}
+	}
+}
@@ -45,6 +45,8 @@ func (i *Instance) xqd_log_write(handle int32, addr int32, size int32, nwritten_
 		return XqdError
 	}
 
+	i.usage.LogBytes += nwritten
+
 	// Write out how many bytes we copied
 	i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
 
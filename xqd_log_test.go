@@ -0,0 +1,92 @@
+package fastlike
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLogSink(t *testing.T) {
+	var messages [][2]string
+	var access bytes.Buffer
+
+	i := newTestInstance(t,
+		WithLogger("access", &access),
+		WithLogSink(func(endpoint, message string) {
+			messages = append(messages, [2]string{endpoint, message})
+		}),
+	)
+
+	// endpoint_get returns the same handle every time it's called with the same name
+	var handles = map[string]uint32{}
+	for _, name := range []string{"access", "errors", "errors"} {
+		i.memory.WriteAt([]byte(name), 100)
+		if s := i.xqd_log_endpoint_get(100, int32(len(name)), 200); s != XqdStatusOK {
+			t.Fatalf("endpoint_get: expected status %d, got %d", XqdStatusOK, s)
+		}
+		if h, ok := handles[name]; ok && h != i.memory.Uint32(200) {
+			t.Errorf("endpoint_get: expected handle %d for %q, got %d", h, name, i.memory.Uint32(200))
+		}
+		handles[name] = i.memory.Uint32(200)
+	}
+
+	for _, msg := range []string{"first\n", "second"} {
+		i.memory.WriteAt([]byte(msg), 300)
+		i.xqd_log_write(int32(handles["errors"]), 300, int32(len(msg)), 200)
+	}
+	i.memory.WriteAt([]byte("GET /"), 300)
+	i.xqd_log_write(int32(handles["access"]), 300, 5, 200)
+
+	// unfinished lines are held back until the guest is done
+	if len(messages) != 1 || access.Len() != 0 {
+		t.Errorf("expected partial lines to be buffered, got messages %q and access log %q", messages, access.String())
+	}
+	i.flushLoggers()
+
+	if len(messages) != 2 || messages[0] != [2]string{"errors", "first"} || messages[1] != [2]string{"errors", "second"} {
+		t.Errorf("unexpected sink messages %q", messages)
+	}
+
+	// endpoints with their own logger don't go to the sink
+	if access.String() != "GET /" {
+		t.Errorf("expected access log %q, got %q", "GET /", access.String())
+	}
+}
+
+func TestLogWritePartialLines(t *testing.T) {
+	var messages []string
+	i := newTestInstance(t, WithLogSink(func(_, message string) {
+		messages = append(messages, message)
+	}))
+
+	i.memory.WriteAt([]byte("app"), 100)
+	i.xqd_log_endpoint_get(100, 3, 200)
+	var handle = int32(i.memory.Uint32(200))
+
+	// one line, split across three writes, in the middle of a multi-byte character
+	var line = []byte("héllo, wörld\n")
+	for _, part := range [][]byte{line[:2], line[2:9], line[9:]} {
+		i.memory.WriteAt(part, 300)
+		if s := i.xqd_log_write(handle, 300, int32(len(part)), 400); s != XqdStatusOK {
+			t.Fatalf("log_write: expected status %d, got %d", XqdStatusOK, s)
+		}
+		if n := i.memory.Uint32(400); n != uint32(len(part)) {
+			t.Errorf("log_write: expected nwritten %d, got %d", len(part), n)
+		}
+	}
+	i.flushLoggers()
+
+	if len(messages) != 1 || messages[0] != "héllo, wörld" {
+		t.Errorf("expected a single assembled line, got %q", messages)
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewPrefixWriter("app", LineWriter{&out})
+	if _, err := w.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "app: hello\n" {
+		t.Errorf("expected %q, got %q", "app: hello\n", out.String())
+	}
+}
@@ -3,6 +3,8 @@ package fastlike
 // xqd_multivalue is not an actual ABI method, but it's an implementation of a mechanism used by
 // the guest to make multiple hostcalls via a cursor
 // For usage, see the abi methods for headers
+// Exactly one value is written per call, so the amount of work per call is bounded by the size of a
+// single value. The ending cursor points at the next unwritten value, or -1 when there are none.
 func xqd_multivalue(memory *Memory, data []string, addr int32, maxlen int32, cursor int32, ending_cursor_out int32, nwritten_out int32) int32 {
 	// If there's no data, return early
 	if len(data) == 0 {
@@ -23,6 +25,8 @@ func xqd_multivalue(memory *Memory, data []string, addr int32, maxlen int32, cur
 	}
 
 	if len([]byte(data[cursor]))+1 > int(maxlen) {
+		// Let the guest know how big of a buffer it needs for this value, including the nul
+		memory.PutUint32(uint32(len([]byte(data[cursor]))+1), int64(nwritten_out))
 		return XqdErrBufferLength
 	}
 	var v = []byte(data[cursor])
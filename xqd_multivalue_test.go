@@ -0,0 +1,72 @@
+package fastlike
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMultivaluePaging(t *testing.T) {
+	const (
+		addr     = 100
+		maxlen   = 16
+		cursorp  = 200
+		nwritten = 300
+		count    = 10000
+	)
+
+	var memory = &Memory{ByteMemory(make([]byte, 1024))}
+	var data = make([]string, count)
+	for j := range data {
+		data[j] = fmt.Sprintf("value-%05d", j)
+	}
+
+	var seen = map[string]bool{}
+	var cursor int64
+	for calls := 0; cursor != -1; calls++ {
+		if calls > count {
+			t.Fatalf("cursor never finished after %d calls", calls)
+		}
+
+		if s := xqd_multivalue(memory, data, addr, maxlen, int32(cursor), cursorp, nwritten); s != XqdStatusOK {
+			t.Fatalf("expected status %d at cursor %d, got %d", XqdStatusOK, cursor, s)
+		}
+
+		n := memory.Uint32(nwritten)
+		value := string(memory.Data()[addr : addr+n-1])
+		if value != data[cursor] {
+			t.Fatalf("expected %q at cursor %d, got %q", data[cursor], cursor, value)
+		}
+		if seen[value] {
+			t.Fatalf("got duplicate value %q at cursor %d", value, cursor)
+		}
+		seen[value] = true
+
+		next := int64(memory.Uint64(cursorp))
+		if next != -1 && next != cursor+1 {
+			t.Fatalf("expected ending cursor %d, got %d", cursor+1, next)
+		}
+		cursor = next
+	}
+
+	if len(seen) != count {
+		t.Errorf("expected %d values, got %d", count, len(seen))
+	}
+}
+
+func TestMultivalueHeaderOrder(t *testing.T) {
+	i := newTestInstance(t)
+	rhid, rh := i.requests.New()
+	rh.Header = map[string][]string{"Test-Header": {"b", "a"}}
+
+	i.memory.WriteAt([]byte("test-header"), 100)
+	if s := i.xqd_req_header_values_get(int32(rhid), 100, 11, 200, 16, 0, 300, 400); s != XqdStatusOK {
+		t.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+	}
+
+	if v := string(i.memory.Data()[200:201]); v != "a" {
+		t.Errorf("expected values to be returned in sorted order, got %q first", v)
+	}
+	if v := rh.Header["Test-Header"]; v[0] != "b" || v[1] != "a" {
+		t.Errorf("expected header values to keep their order, got %q", v)
+	}
+}
@@ -2,38 +2,87 @@ package fastlike
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 func (i *Instance) xqd_req_version_get(handle int32, version_out int32) int32 {
-	if i.requests.Get(int(handle)) == nil {
+	var r = i.requests.Get(int(handle))
+	if r == nil {
 		i.abilog.Printf("req_version_get: invalid handle %d", handle)
 		return XqdErrInvalidHandle
 	}
 
-	i.abilog.Printf("req_version_get: handle=%d version=%d", handle, Http11)
-	i.memory.PutUint32(uint32(Http11), int64(version_out))
+	var version = httpVersion(r.ProtoMajor, r.ProtoMinor)
+	i.abilog.Printf("req_version_get: handle=%d version=%d", handle, version)
+	i.memory.PutUint32(uint32(version), int64(version_out))
 	return XqdStatusOK
 }
 
+// httpVersion converts a protocol version, as found on http.Request and http.Response, into the
+// matching XQD version constant. Requests and responses created by the guest don't have a version,
+// and are treated as HTTP/1.1.
+func httpVersion(major, minor int) int32 {
+	switch {
+	case major == 0 && minor == 9:
+		return Http09
+	case major == 1 && minor == 0:
+		return Http10
+	case major == 2:
+		return Http2
+	case major == 3:
+		return Http3
+	default:
+		return Http11
+	}
+}
+
+// httpProto is the inverse of httpVersion, converting an XQD version constant into the protocol
+// version found on http.Request and http.Response. It returns false for unknown constants.
+func httpProto(version int32) (proto string, major, minor int, ok bool) {
+	switch version {
+	case Http09:
+		return "HTTP/0.9", 0, 9, true
+	case Http10:
+		return "HTTP/1.0", 1, 0, true
+	case Http11:
+		return "HTTP/1.1", 1, 1, true
+	case Http2:
+		return "HTTP/2.0", 2, 0, true
+	case Http3:
+		return "HTTP/3.0", 3, 0, true
+	default:
+		return "", 0, 0, false
+	}
+}
+
+// xqd_req_version_set records the version on the request handle, so that req_version_get reports
+// it back. Subrequests are always sent with whatever version the backend negotiates.
 func (i *Instance) xqd_req_version_set(handle int32, version int32) int32 {
 	i.abilog.Printf("req_version_set: handle=%d version=%d", handle, version)
 
-	if i.requests.Get(int(handle)) == nil {
+	var r = i.requests.Get(int(handle))
+	if r == nil {
 		i.abilog.Printf("req_version_set: invalid handle %d", handle)
 		return XqdErrInvalidHandle
 	}
 
-	if version != int32(Http11) {
+	var proto, major, minor, ok = httpProto(version)
+	if !ok {
 		i.abilog.Printf("req_version_set: invalid version %d", version)
-		return XqdErrUnsupported
+		return XqdErrInvalidArgument
 	}
 
+	r.Proto, r.ProtoMajor, r.ProtoMinor = proto, major, minor
 	return XqdStatusOK
 }
 
@@ -67,6 +116,7 @@ func (i *Instance) xqd_req_method_get(handle int32, addr int32, maxlen int32, nw
 	}
 
 	if int(maxlen) < len(r.Method) {
+		i.memory.PutUint32(uint32(len(r.Method)), int64(nwritten_out))
 		return XqdErrBufferLength
 	}
 
@@ -197,7 +247,16 @@ func (i *Instance) xqd_req_header_value_get(handle int32, name_addr int32, name_
 	i.abilog.Printf("req_header_value_get: handle=%d header=%q\n", handle, header)
 
 	value := r.Header.Get(header)
+	if int(maxlen) < len(value) {
+		i.memory.PutUint32(uint32(len(value)), int64(nwritten_out))
+		return XqdErrBufferLength
+	}
+
 	nwritten, err := i.memory.WriteAt([]byte(value), int64(addr))
+	if err != nil {
+		return XqdError
+	}
+
 	i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
 
 	return XqdStatusOK
@@ -219,10 +278,8 @@ func (i *Instance) xqd_req_header_values_get(handle int32, name_addr int32, name
 
 	i.abilog.Printf("req_header_values_get: handle=%d header=%q cursor=%d\n", handle, header, cursor)
 
-	var values, ok = r.Header[header]
-	if !ok {
-		values = []string{}
-	}
+	// Copy the values so sorting them doesn't reorder the header itself
+	var values = append([]string{}, r.Header[header]...)
 
 	// Sort the values otherwise cursors don't work
 	sort.Strings(values[:])
@@ -276,6 +333,11 @@ func (i *Instance) xqd_req_uri_get(handle int32, addr int32, maxlen int32, nwrit
 	uri := r.URL.String()
 	i.abilog.Printf("req_uri_get: handle=%d uri=%q", handle, uri)
 
+	if int(maxlen) < len(uri) {
+		i.memory.PutUint32(uint32(len(uri)), int64(nwritten_out))
+		return XqdErrBufferLength
+	}
+
 	nwritten, err := i.memory.WriteAt([]byte(uri), int64(addr))
 	if err != nil {
 		return XqdError
@@ -295,31 +357,190 @@ func (i *Instance) xqd_req_new(handle_out int32) int32 {
 func (i *Instance) xqd_req_send(rhandle int32, bhandle int32, backend_addr, backend_size int32, wh_out int32, bh_out int32) int32 {
 	// sends the request described by (rh, bh) to the backend
 	// expects a response handle and response body handle
+	var req, rt, status = i.subrequest("req_send", rhandle, bhandle, backend_addr, backend_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	var w = fetch(rt, req)
+
+	var whid, bhid = i.newResponse(w)
+
+	i.abilog.Printf("req_send: response handle=%d body=%d", whid, bhid)
+
+	i.memory.PutUint32(uint32(whid), int64(wh_out))
+	i.memory.PutUint32(uint32(bhid), int64(bh_out))
+
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_req_send_async(rhandle int32, bhandle int32, backend_addr, backend_size int32, ph_out int32) int32 {
+	// sends the request described by (rh, bh) to the backend in the background, and returns a
+	// pending request handle which can be polled, waited on, or selected by the guest
+	var req, rt, status = i.subrequest("req_send_async", rhandle, bhandle, backend_addr, backend_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	var phid, ph = i.pending.New()
+
+	// The guest may never come back for the response, so the subrequest gets canceled when the
+	// instance is reset
+	var ctx context.Context
+	ctx, ph.cancel = context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+
+	go func() {
+		ph.response = fetch(rt, req)
+		close(ph.done)
+	}()
+
+	i.abilog.Printf("req_send_async: pending handle=%d", phid)
+
+	i.memory.PutUint32(uint32(phid), int64(ph_out))
+
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_pending_req_poll(phandle int32, is_done_out int32, wh_out int32, bh_out int32) int32 {
+	var ph = i.pending.Get(int(phandle))
+	if ph == nil || ph.claimed {
+		i.abilog.Printf("pending_req_poll: invalid pending handle=%d", phandle)
+		return XqdErrInvalidHandle
+	}
+
+	if !ph.ready() {
+		i.abilog.Printf("pending_req_poll: handle=%d not done", phandle)
+		i.memory.PutUint32(0, int64(is_done_out))
+		i.memory.PutUint32(HandleInvalid, int64(wh_out))
+		i.memory.PutUint32(HandleInvalid, int64(bh_out))
+		return XqdStatusOK
+	}
+
+	i.memory.PutUint32(1, int64(is_done_out))
+	i.claimPending("pending_req_poll", ph, wh_out, bh_out)
+
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_pending_req_wait(phandle int32, wh_out int32, bh_out int32) int32 {
+	var ph = i.pending.Get(int(phandle))
+	if ph == nil || ph.claimed {
+		i.abilog.Printf("pending_req_wait: invalid pending handle=%d", phandle)
+		return XqdErrInvalidHandle
+	}
+
+	<-ph.done
+	i.claimPending("pending_req_wait", ph, wh_out, bh_out)
+
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_pending_req_select(phandles_addr int32, phandles_len int32, done_idx_out int32, wh_out int32, bh_out int32) int32 {
+	if phandles_len <= 0 {
+		return XqdErrInvalidArgument
+	}
+
+	var handles = make([]*PendingRequestHandle, phandles_len)
+	for j := range handles {
+		var id = i.memory.Uint32(int64(phandles_addr) + int64(j)*4)
+		handles[j] = i.pending.Get(int(id))
+		if handles[j] == nil || handles[j].claimed {
+			i.abilog.Printf("pending_req_select: invalid pending handle=%d", id)
+			return XqdErrInvalidHandle
+		}
+	}
+
+	var cases = make([]reflect.SelectCase, len(handles))
+	for j, ph := range handles {
+		cases[j] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ph.done)}
+	}
+
+	// When several requests are done at once, select picks one of them at random unless
+	// deterministic async is enabled, in which case the first one in the list wins
+	var idx, _, _ = reflect.Select(cases)
+	if i.deterministicAsync {
+		for j, ph := range handles {
+			if ph.ready() {
+				idx = j
+				break
+			}
+		}
+	}
+
+	i.abilog.Printf("pending_req_select: done index=%d", idx)
+
+	i.memory.PutUint32(uint32(idx), int64(done_idx_out))
+	i.claimPending("pending_req_select", handles[idx], wh_out, bh_out)
+
+	return XqdStatusOK
+}
+
+// claimPending turns the response of a finished pending request into an (rh, bh) pair and writes
+// out their handles
+func (i *Instance) claimPending(method string, ph *PendingRequestHandle, wh_out int32, bh_out int32) {
+	ph.claimed = true
+
+	var whid, bhid = i.newResponse(ph.response)
+
+	i.abilog.Printf("%s: response handle=%d body=%d", method, whid, bhid)
+
+	i.memory.PutUint32(uint32(whid), int64(wh_out))
+	i.memory.PutUint32(uint32(bhid), int64(bh_out))
+}
+
+// subrequest builds the outgoing request described by the (rh, bh) pair and looks up the handler
+// for the named backend. Mirrors of the backend are sent here as well.
+func (i *Instance) subrequest(method string, rhandle int32, bhandle int32, backend_addr, backend_size int32) (*http.Request, http.RoundTripper, int32) {
 	var r = i.requests.Get(int(rhandle))
 	if r == nil {
-		i.abilog.Printf("req_send: invalid request handle=%d", rhandle)
-		return XqdErrInvalidHandle
+		i.abilog.Printf("%s: invalid request handle=%d", method, rhandle)
+		return nil, nil, XqdErrInvalidHandle
 	}
 
 	var b = i.bodies.Get(int(bhandle))
 	if b == nil {
-		i.abilog.Printf("req_send: invalid body handle=%d", bhandle)
-		return XqdErrInvalidHandle
+		i.abilog.Printf("%s: invalid body handle=%d", method, bhandle)
+		return nil, nil, XqdErrInvalidHandle
 	}
 
 	var buf = make([]byte, backend_size)
 	_, err := i.memory.ReadAt(buf, int64(backend_addr))
 	if err != nil {
-		return XqdError
+		return nil, nil, XqdError
 	}
 
 	var backend = string(buf)
 
-	i.abilog.Printf("req_send: handle=%d body=%d backend=%q uri=%q", rhandle, bhandle, backend, r.URL)
+	i.abilog.Printf("%s: handle=%d body=%d backend=%q uri=%q", method, rhandle, bhandle, backend, r.URL)
+
+	i.usage.Subrequests++
+	i.incr("subrequests", "backend:"+backend)
+
+	// Subrequests get a copy of the body rather than the body itself, so the guest can send the same
+	// body more than once, such as to fan out to several backends, and mirrors can have it too
+	if err := b.buffer(); err != nil {
+		i.abilog.Printf("%s: error reading body=%d, got %s", method, bhandle, err.Error())
+		return nil, nil, XqdError
+	}
+	var size = b.Size()
+	var mirrors = i.mirrors[backend]
+	var bodybytes = append([]byte{}, b.buf.Bytes()...)
+	var body = bytes.NewReader(bodybytes)
+
+	// Subrequests are canceled along with the downstream request, such as when the client goes away
+	var ctx = context.Background()
+	if i.ds_context != nil {
+		ctx = i.ds_context
+	}
+	ctx = withClock(ctx, i.clock)
+	if len(i.hosts) > 0 {
+		ctx = withHosts(ctx, i.hosts)
+	}
 
-	req, err := http.NewRequest(r.Method, r.URL.String(), b)
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.URL.String(), body)
 	if err != nil {
-		return XqdErrHttpUserInvalid
+		return nil, nil, XqdErrHttpUserInvalid
 	}
 
 	req.Header = r.Header.Clone()
@@ -329,51 +550,231 @@ func (i *Instance) xqd_req_send(rhandle int32, bhandle int32, backend_addr, back
 		req.Header = http.Header{}
 	}
 
+	// net/http takes the Host header from req.Host and ignores the one in req.Header, so move over
+	// the one the guest set. A BackendConfig with an OverrideHost replaces it again.
+	if host := req.Header.Get("host"); host != "" {
+		req.Host = host
+		req.Header.Del("host")
+	}
+
 	// Make sure to add a CDN-Loop header, which we can check (and block) at ingress
 	req.Header.Add("cdn-loop", "fastlike")
 
-	// TODO: Not sure if this is strictly necessary (or correct!)
-	if req.Header.Get("content-length") == "" {
-		req.Header.Add("content-length", fmt.Sprintf("%d", b.Size()))
-		req.ContentLength = b.Size()
-	} else if req.ContentLength <= 0 {
-		req.ContentLength = b.Size()
+	// Bodies of unknown length are sent chunked
+	req.Header.Del("content-length")
+	req.ContentLength = size
+	if size >= 0 {
+		req.Header.Set("content-length", fmt.Sprintf("%d", size))
+	}
+
+	for _, m := range mirrors {
+		i.mirror(m, req, bodybytes)
 	}
 
 	// If the backend is geolocation, we select the geobackend explicitly
-	var handler http.Handler
+	var rt http.RoundTripper
 	if backend == "geolocation" {
-		handler = geoHandler(i.geolookup)
+		rt = handlerTransport{geoHandler(i.geolookup)}
 	} else {
-		handler = i.getBackend(backend)
+		rt = i.getTransport(backend)
+	}
+
+	if i.subrequestRecorder != nil {
+		rt = recordedTransport{rt, backend, i.subrequestRecorder}
+	}
+
+	return req, rt, XqdStatusOK
+}
+
+// fetch sends req with rt and returns the response. If rt fails to get a response at all, the guest
+// sees a 502, the same as it would for a BackendConfig origin that couldn't be reached.
+func fetch(rt http.RoundTripper, req *http.Request) *http.Response {
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		var wr = httptest.NewRecorder()
+		wr.WriteHeader(http.StatusBadGateway)
+		return wr.Result()
 	}
 
-	// TODO: Is there a better way to get an *http.Response from an http.Handler?
+	return res
+}
+
+// handlerTransport adapts an http.Handler backend to an http.RoundTripper
+type handlerTransport struct{ http.Handler }
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return roundtrip(t.Handler, req)
+}
+
+// roundtrip sends req to handler and returns the response it writes. It returns as soon as the
+// handler has written its headers, and the body is streamed from the handler as the guest reads it.
+// If the handler aborts the response by panicking with http.ErrAbortHandler, as a dropped
+// connection would, reading the body fails with io.ErrUnexpectedEOF after whatever was written
+// before the abort. Any other panic before the headers are written is returned as an error, which
+// fetch turns into a 502, since it may be on a goroutine with nothing to recover it. After the
+// headers, it fails the body instead.
+func roundtrip(handler http.Handler, req *http.Request) (*http.Response, error) {
 	// The Handler interface is useful for embedders, since often-times they'll be processing wasm
 	// requests in the embedding application, and it's very easy to adapt an http.Handler to an
 	// http.RoundTripper if they want it to go offsite.
-	wr := httptest.NewRecorder()
-	handler.ServeHTTP(wr, req)
+	var conn = &backendConn{}
+	var pr, pw = io.Pipe()
+	var sw = &streamWriter{header: http.Header{}, pw: pw, ready: make(chan struct{})}
+	var panicked = make(chan interface{}, 1)
+
+	go func() {
+		defer func() {
+			var v = recover()
+			if v != nil && v != http.ErrAbortHandler && sw.sent == nil {
+				panicked <- v
+			}
+
+			sw.WriteHeader(http.StatusOK)
+			switch v {
+			case nil:
+				pw.Close()
+			case http.ErrAbortHandler:
+				pw.CloseWithError(io.ErrUnexpectedEOF)
+			default:
+				pw.CloseWithError(fmt.Errorf("backend panicked: %v", v))
+			}
+		}()
+
+		handler.ServeHTTP(sw, req.WithContext(withBackendConn(req.Context(), conn)))
+	}()
+
+	<-sw.ready
+	select {
+	case v := <-panicked:
+		return nil, fmt.Errorf("backend panicked: %v", v)
+	default:
+	}
+
+	var w = &http.Response{
+		Status:        fmt.Sprintf("%03d %s", sw.code, http.StatusText(sw.code)),
+		StatusCode:    sw.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        sw.sent,
+		Body:          pr,
+		ContentLength: -1,
+		Request:       req,
+	}
+
+	if n, err := strconv.ParseInt(w.Header.Get("content-length"), 10, 64); err == nil && n >= 0 {
+		w.ContentLength = n
+	}
+
+	// The handler has written its headers, so the connection details are in by now
+	if conn.major != 0 {
+		w.Proto = fmt.Sprintf("HTTP/%d.%d", conn.major, conn.minor)
+		w.ProtoMajor, w.ProtoMinor = conn.major, conn.minor
+	}
+	w.TLS = conn.tls
+
+	return w, nil
+}
+
+// streamWriter is an http.ResponseWriter which passes the body on through a pipe as it's written,
+// so that the guest can read a response while the handler is still writing it. Writes block until
+// the guest reads them, or fail once the body is closed.
+type streamWriter struct {
+	header http.Header
+	pw     *io.PipeWriter
+
+	// code and sent are the status and headers as they were when the headers were written, which
+	// is when ready is closed
+	code  int
+	sent  http.Header
+	ready chan struct{}
+}
+
+func (w *streamWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamWriter) WriteHeader(code int) {
+	// Informational responses are followed by the real one
+	if w.sent != nil || (code >= 100 && code < 200 && code != http.StatusSwitchingProtocols) {
+		return
+	}
+
+	w.code, w.sent = code, w.header.Clone()
+	close(w.ready)
+}
+
+func (w *streamWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(data)
+}
+
+// Flush implements http.Flusher. Everything written is passed on right away, so it only has to
+// make sure the headers are out.
+func (w *streamWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+}
+
+// errReader is an io.Reader which always fails with err
+type errReader struct{ err error }
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// errBodyTooLarge is returned when reading more than the maximum body size from a backend response
+var errBodyTooLarge = errors.New("body exceeds the maximum body size")
+
+// cappedReader is an io.Reader which reads at most n bytes from r, failing with errBodyTooLarge if
+// there are more
+type cappedReader struct {
+	r io.Reader
+	n int64
+}
 
-	w := wr.Result()
+func (c *cappedReader) Read(p []byte) (int, error) {
+	// Read one byte past the cap, so that a body of exactly n bytes isn't an error
+	if int64(len(p)) > c.n+1 {
+		p = p[:c.n+1]
+	}
 
-	// Convert the response into an (rh, bh) pair, put them in the list, and write out the handles
+	n, err := c.r.Read(p)
+	if int64(n) > c.n {
+		n, c.n = int(c.n), 0
+		return n, errBodyTooLarge
+	}
+
+	c.n -= int64(n)
+	return n, err
+}
+
+// newResponse converts a subrequest response into an (rh, bh) pair and puts them in the list
+func (i *Instance) newResponse(w *http.Response) (int, int) {
 	var whid, wh = i.responses.New()
 	wh.Status = w.Status
 	wh.StatusCode = w.StatusCode
+	wh.Proto, wh.ProtoMajor, wh.ProtoMinor = w.Proto, w.ProtoMajor, w.ProtoMinor
 	wh.Header = w.Header.Clone()
 	wh.Body = w.Body
 
-	var bhid, _ = i.bodies.NewReader(wh.Body)
-
-	i.abilog.Printf("req_send: response handle=%d body=%d", whid, bhid)
+	var bhid, bh = i.bodies.NewReader(wh.Body)
+	bh.length = w.ContentLength
 
-	i.memory.PutUint32(uint32(whid), int64(wh_out))
-	i.memory.PutUint32(uint32(bhid), int64(bh_out))
+	if i.maxBodySize > 0 {
+		bh.reader = &cappedReader{r: bh.reader, n: i.maxBodySize}
+	}
 
-	return XqdStatusOK
+	return whid, bhid
 }
 
-func (i *Instance) xqd_req_close(handle int32) {
-	i.requests.Get(int(handle)).Close = true
+func (i *Instance) xqd_req_close(handle int32) int32 {
+	var r = i.requests.Get(int(handle))
+	if r == nil {
+		i.abilog.Printf("req_close: invalid handle %d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	i.abilog.Printf("req_close: handle=%d", handle)
+	r.Close = true
+	return XqdStatusOK
 }
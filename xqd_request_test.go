@@ -0,0 +1,400 @@
+package fastlike
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestVersionGet(t *testing.T) {
+	i := newTestInstance(t)
+
+	var cases = []struct {
+		name         string
+		major, minor int
+		version      int32
+	}{
+		{"guest-created", 0, 0, Http11},
+		{"http/1.0", 1, 0, Http10},
+		{"http/1.1", 1, 1, Http11},
+		{"h2c", 2, 0, Http2},
+	}
+
+	for _, c := range cases {
+		rhid, rh := i.requests.New()
+		rh.ProtoMajor, rh.ProtoMinor = c.major, c.minor
+
+		if s := i.xqd_req_version_get(int32(rhid), 100); s != XqdStatusOK {
+			t.Fatalf("%s: expected status %d, got %d", c.name, XqdStatusOK, s)
+		}
+		if v := int32(i.memory.Uint32(100)); v != c.version {
+			t.Errorf("%s: expected version %d, got %d", c.name, c.version, v)
+		}
+	}
+}
+
+func TestRequestVersionSet(t *testing.T) {
+	i := newTestInstance(t)
+	rhid, rh := i.requests.New()
+
+	if s := i.xqd_req_version_set(int32(rhid), Http2); s != XqdStatusOK {
+		t.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+	}
+	if rh.Proto != "HTTP/2.0" || rh.ProtoMajor != 2 || rh.ProtoMinor != 0 {
+		t.Errorf("expected HTTP/2.0, got %s (%d.%d)", rh.Proto, rh.ProtoMajor, rh.ProtoMinor)
+	}
+
+	if s := i.xqd_req_version_set(int32(rhid), 42); s != XqdErrInvalidArgument {
+		t.Errorf("expected status %d for an unknown version, got %d", XqdErrInvalidArgument, s)
+	}
+}
+
+// send sends a GET to the named backend with req_send, returning the response and body handles
+func send(t *testing.T, i *Instance, backend string) (uint32, uint32) {
+	t.Helper()
+	rhid, rh := i.requests.New()
+	rh.Method = "GET"
+	rh.URL, _ = url.Parse("http://localhost/" + backend)
+	bhid, _ := i.bodies.NewBuffer()
+
+	i.memory.WriteAt([]byte(backend), 200)
+	if s := i.xqd_req_send(int32(rhid), int32(bhid), 200, int32(len(backend)), 100, 104); s != XqdStatusOK {
+		t.Fatalf("send: expected status %d, got %d", XqdStatusOK, s)
+	}
+	return i.memory.Uint32(100), i.memory.Uint32(104)
+}
+
+// sendAsync sends a GET to the named backend with send_async, returning the pending handle
+func sendAsync(t *testing.T, i *Instance, backend string) uint32 {
+	t.Helper()
+	rhid, rh := i.requests.New()
+	rh.Method = "GET"
+	rh.URL, _ = url.Parse("http://localhost/" + backend)
+	bhid, _ := i.bodies.NewBuffer()
+
+	i.memory.WriteAt([]byte(backend), 200)
+	if s := i.xqd_req_send_async(int32(rhid), int32(bhid), 200, int32(len(backend)), 100); s != XqdStatusOK {
+		t.Fatalf("send_async: expected status %d, got %d", XqdStatusOK, s)
+	}
+	return i.memory.Uint32(100)
+}
+
+func TestPendingRequest(t *testing.T) {
+	var release = make(chan struct{})
+	i := newTestInstance(t, WithBackend("slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusTeapot)
+	})))
+
+	ph := sendAsync(t, i, "slow")
+
+	if s := i.xqd_pending_req_poll(int32(ph), 300, 304, 308); s != XqdStatusOK {
+		t.Fatalf("poll: expected status %d, got %d", XqdStatusOK, s)
+	}
+	if done := i.memory.Uint32(300); done != 0 {
+		t.Fatalf("poll: expected request to be pending, got is_done=%d", done)
+	}
+
+	close(release)
+
+	if s := i.xqd_pending_req_wait(int32(ph), 304, 308); s != XqdStatusOK {
+		t.Fatalf("wait: expected status %d, got %d", XqdStatusOK, s)
+	}
+	if w := i.responses.Get(int(i.memory.Uint32(304))); w == nil || w.StatusCode != http.StatusTeapot {
+		t.Errorf("wait: expected a 418 response, got %+v", w)
+	}
+
+	// Once a pending request has produced a response, its handle is spent
+	if s := i.xqd_pending_req_wait(int32(ph), 304, 308); s != XqdErrInvalidHandle {
+		t.Errorf("wait: expected status %d for a spent handle, got %d", XqdErrInvalidHandle, s)
+	}
+}
+
+func TestBackendPanic(t *testing.T) {
+	var panicked = make(chan struct{}, 2)
+	var panics = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { panicked <- struct{}{} }()
+		panic("backend bug")
+	})
+
+	i := newTestInstance(t,
+		WithBackend("panics", panics),
+		WithBackend("primary", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})),
+		WithMirror("primary", "panics"),
+	)
+
+	// Async subrequests and mirrors run on their own goroutines, so a panic there would take the
+	// whole process down instead of becoming a 502
+	var phid = sendAsync(t, i, "panics")
+	if s := i.xqd_pending_req_wait(int32(phid), 100, 104); s != XqdStatusOK {
+		t.Fatalf("pending_req_wait: expected status %d, got %d", XqdStatusOK, s)
+	}
+	if code := i.responses.Get(int(i.memory.Uint32(100))).StatusCode; code != http.StatusBadGateway {
+		t.Errorf("expected a panicking backend to respond %d, got %d", http.StatusBadGateway, code)
+	}
+
+	send(t, i, "primary")
+	<-panicked
+	<-panicked
+
+	// Give the mirror's goroutine a moment to finish, which is when the panic would have surfaced
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestPendingRequestAbandoned(t *testing.T) {
+	var canceled = make(chan struct{})
+	i := newTestInstance(t, WithBackend("slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(canceled)
+	})))
+
+	sendAsync(t, i, "slow")
+
+	// The guest finishing without waiting on the request abandons it
+	i.reset()
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the abandoned subrequest to be canceled")
+	}
+}
+
+func TestSubrequestContext(t *testing.T) {
+	// backend returns a backend which blocks until its request is canceled, along with channels
+	// closed when the request starts and when it's canceled
+	backend := func() (Option, chan struct{}, chan struct{}) {
+		var started, canceled = make(chan struct{}), make(chan struct{})
+		return WithBackend("backend", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-r.Context().Done()
+			close(canceled)
+		})), started, canceled
+	}
+
+	t.Run("client disconnect", func(st *testing.T) {
+		backend, started, canceled := backend()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go func() {
+			<-started
+			cancel()
+		}()
+
+		r := httptest.NewRequest("GET", "http://localhost:1337/", nil).WithContext(ctx)
+		serve(st, proxyWat, r, backend)
+
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			st.Fatal("expected the subrequest to be canceled with the downstream request")
+		}
+	})
+
+	t.Run("context func", func(st *testing.T) {
+		backend, started, canceled := backend()
+		var fn = func(r *http.Request) context.Context {
+			ctx, cancel := context.WithCancel(r.Context())
+			go func() {
+				<-started
+				cancel()
+			}()
+			return ctx
+		}
+
+		serve(st, proxyWat, httptest.NewRequest("GET", "http://localhost:1337/", nil), backend, WithRequestContextFunc(fn))
+
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			st.Fatal("expected the subrequest to be canceled with the supplied context")
+		}
+	})
+}
+
+func TestDeterministicAsync(t *testing.T) {
+	for n := 0; n < 20; n++ {
+		i := newTestInstance(t, WithDeterministicAsync(), WithDefaultBackend(func(name string) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("backend", name)
+			})
+		}))
+
+		first, second := sendAsync(t, i, "first"), sendAsync(t, i, "second")
+
+		// Make sure both are done, so select has to break a tie
+		for _, ph := range []uint32{first, second} {
+			select {
+			case <-i.pending.Get(int(ph)).done:
+			case <-time.After(time.Second):
+				t.Fatal("pending request never finished")
+			}
+		}
+
+		// List the second request first; it must win every time
+		i.memory.PutUint32(second, 400)
+		i.memory.PutUint32(first, 404)
+		if s := i.xqd_pending_req_select(400, 2, 300, 304, 308); s != XqdStatusOK {
+			t.Fatalf("select: expected status %d, got %d", XqdStatusOK, s)
+		}
+
+		if idx := i.memory.Uint32(300); idx != 0 {
+			t.Fatalf("select: expected done index 0, got %d", idx)
+		}
+		if w := i.responses.Get(int(i.memory.Uint32(304))); w.Header.Get("backend") != "second" {
+			t.Fatalf("select: expected the response from %q, got %q", "second", w.Header.Get("backend"))
+		}
+	}
+}
+
+func TestSendFanOut(t *testing.T) {
+	var got = map[string]string{}
+	var backend = func(name string) Option {
+		return WithBackend(name, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			got[name] = string(body)
+		}))
+	}
+
+	i := newTestInstance(t, backend("first"), backend("second"))
+
+	var bodies = map[string]func() int{
+		"buffered": func() int {
+			bhid, bh := i.bodies.NewBuffer()
+			bh.Write([]byte("upload"))
+			return bhid
+		},
+		"streamed": func() int {
+			bhid, _ := i.bodies.NewReader(ioutil.NopCloser(strings.NewReader("upload")))
+			return bhid
+		},
+	}
+
+	for name, body := range bodies {
+		got = map[string]string{}
+		rhid, rh := i.requests.New()
+		rh.Method = "POST"
+		rh.URL, _ = url.Parse("http://localhost/")
+		bhid := body()
+
+		// The same request and body go to both backends
+		for _, b := range []string{"first", "second"} {
+			i.memory.WriteAt([]byte(b), 200)
+			if s := i.xqd_req_send(int32(rhid), int32(bhid), 200, int32(len(b)), 100, 104); s != XqdStatusOK {
+				t.Fatalf("%s: expected status %d sending to %s, got %d", name, XqdStatusOK, b, s)
+			}
+		}
+
+		if got["first"] != "upload" || got["second"] != "upload" {
+			t.Errorf("%s: expected both backends to get the full body, got %q", name, got)
+		}
+	}
+}
+
+func TestSendFraming(t *testing.T) {
+	type seen struct {
+		length   int64
+		encoding []string
+		body     string
+	}
+
+	var got seen
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got = seen{r.ContentLength, r.TransferEncoding, string(body)}
+	}))
+	defer origin.Close()
+
+	i := newTestInstance(t, WithBackendConfig("origin", BackendConfig{URL: origin.URL}))
+
+	var cases = []struct {
+		name     string
+		body     func() int
+		expected seen
+	}{
+		{"known-length", func() int {
+			bhid, bh := i.bodies.NewBuffer()
+			bh.Write([]byte("upload"))
+			return bhid
+		}, seen{6, nil, "upload"}},
+		{"unknown-length", func() int {
+			bhid, _ := i.bodies.NewReader(ioutil.NopCloser(strings.NewReader("upload")))
+			return bhid
+		}, seen{-1, []string{"chunked"}, "upload"}},
+	}
+
+	for _, c := range cases {
+		got = seen{}
+		rhid, rh := i.requests.New()
+		rh.Method = "POST"
+		rh.URL, _ = url.Parse("http://localhost/")
+		rh.Header = http.Header{"Content-Length": []string{"100"}}
+
+		i.memory.WriteAt([]byte("origin"), 200)
+		if s := i.xqd_req_send(int32(rhid), int32(c.body()), 200, 6, 100, 104); s != XqdStatusOK {
+			t.Fatalf("%s: expected status %d, got %d", c.name, XqdStatusOK, s)
+		}
+
+		if got.length != c.expected.length || strings.Join(got.encoding, ",") != strings.Join(c.expected.encoding, ",") || got.body != c.expected.body {
+			t.Errorf("%s: expected origin to see %+v, got %+v", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestSendStreaming(t *testing.T) {
+	var release = make(chan struct{})
+	i := newTestInstance(t, WithBackend("stream", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-length", "11")
+		w.Write([]byte("first"))
+		<-release
+		w.Write([]byte(" second"))
+	})))
+
+	// The response is handed over as soon as its headers are written
+	var sent = make(chan [2]uint32)
+	go func() {
+		wh, bh := send(t, i, "stream")
+		sent <- [2]uint32{wh, bh}
+	}()
+
+	var handles [2]uint32
+	select {
+	case handles = <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("send blocked until the whole body was written")
+	}
+
+	var b = i.bodies.Get(int(handles[1]))
+	if b.Size() != 11 {
+		t.Errorf("expected the body length from content-length, got %d", b.Size())
+	}
+
+	var buf = make([]byte, 5)
+	if _, err := io.ReadFull(b, buf); err != nil || string(buf) != "first" {
+		t.Fatalf("expected to read %q before the backend finished, got %q (%v)", "first", buf, err)
+	}
+
+	close(release)
+	if rest, err := ioutil.ReadAll(b); err != nil || string(rest) != " second" {
+		t.Errorf("expected the rest of the body %q, got %q (%v)", " second", rest, err)
+	}
+}
+
+func TestRequestClose(t *testing.T) {
+	i := newTestInstance(t)
+	rhid, rh := i.requests.New()
+
+	if s := i.xqd_req_close(int32(rhid)); s != XqdStatusOK || !rh.Close {
+		t.Errorf("expected status %d and the request marked closed, got %d (close=%t)", XqdStatusOK, s, rh.Close)
+	}
+	if s := i.xqd_req_close(int32(rhid + 1)); s != XqdErrInvalidHandle {
+		t.Errorf("expected status %d for an invalid handle, got %d", XqdErrInvalidHandle, s)
+	}
+}
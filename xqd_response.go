@@ -2,8 +2,10 @@ package fastlike
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"sort"
+	"strings"
 )
 
 func (i *Instance) xqd_resp_new(handle_out int32) int32 {
@@ -22,7 +24,7 @@ func (i *Instance) xqd_resp_status_set(handle int32, status int32) int32 {
 	i.abilog.Printf("resp_status_set: handle=%d status=%d", handle, status)
 
 	w.StatusCode = int(status)
-	w.Status = http.StatusText(w.StatusCode)
+	w.Status = statusLine(w.StatusCode)
 	return XqdStatusOK
 }
 
@@ -40,25 +42,34 @@ func (i *Instance) xqd_resp_status_get(handle int32, status_out int32) int32 {
 func (i *Instance) xqd_resp_version_set(handle int32, version int32) int32 {
 	i.abilog.Printf("resp_version_set: handle=%d version=%d", handle, version)
 
-	if i.responses.Get(int(handle)) == nil {
+	var w = i.responses.Get(int(handle))
+	if w == nil {
 		return XqdErrInvalidHandle
 	}
 
-	if int32(version) != Http11 {
-		i.abilog.Printf("resp_version_set: unsupported version=%d", version)
+	var proto, major, minor, ok = httpProto(version)
+	if !ok {
+		i.abilog.Printf("resp_version_set: invalid version=%d", version)
+		return XqdErrInvalidArgument
 	}
 
+	// The version is only reported back by resp_version_get. Responses sent downstream use whatever
+	// version the client connected with.
+	w.Proto, w.ProtoMajor, w.ProtoMinor = proto, major, minor
 	return XqdStatusOK
 }
 
 func (i *Instance) xqd_resp_version_get(handle int32, version_out int32) int32 {
-	if i.responses.Get(int(handle)) == nil {
+	var w = i.responses.Get(int(handle))
+	if w == nil {
 		return XqdErrInvalidHandle
 	}
 
-	i.abilog.Printf("resp_version_get: handle=%d version=%d", handle, Http11)
+	var version = httpVersion(w.ProtoMajor, w.ProtoMinor)
+
+	i.abilog.Printf("resp_version_get: handle=%d version=%d", handle, version)
 
-	i.memory.PutUint32(uint32(Http11), int64(version_out))
+	i.memory.PutUint32(uint32(version), int64(version_out))
 	return XqdStatusOK
 }
 
@@ -111,10 +122,8 @@ func (i *Instance) xqd_resp_header_values_get(handle int32, name_addr int32, nam
 	}
 
 	var header = http.CanonicalHeaderKey(string(buf))
-	var values, ok = w.Header[header]
-	if !ok {
-		values = []string{}
-	}
+	// Copy the values so sorting them doesn't reorder the header itself
+	var values = append([]string{}, w.Header[header]...)
 
 	i.abilog.Printf("resp_header_values_get: handle=%d header=%q cursor=%d\n", handle, header, cursor)
 
@@ -161,6 +170,20 @@ func (i *Instance) xqd_resp_header_values_set(handle int32, name_addr int32, nam
 	return XqdStatusOK
 }
 
-func (i *Instance) xqd_resp_close(handle int32) {
-	i.responses.Get(int(handle)).Close = true
+func (i *Instance) xqd_resp_close(handle int32) int32 {
+	var w = i.responses.Get(int(handle))
+	if w == nil {
+		i.abilog.Printf("resp_close: invalid handle %d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	i.abilog.Printf("resp_close: handle=%d", handle)
+	w.Close = true
+	return XqdStatusOK
+}
+
+// statusLine returns the status of a response in the same form net/http uses for
+// http.Response.Status, ex: "200 OK"
+func statusLine(code int) string {
+	return strings.TrimSpace(fmt.Sprintf("%d %s", code, http.StatusText(code)))
 }
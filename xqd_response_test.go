@@ -0,0 +1,71 @@
+package fastlike
+
+import (
+	"testing"
+)
+
+func TestResponseStatus(t *testing.T) {
+	i := newTestInstance(t)
+	whid, wh := i.responses.New()
+
+	if wh.Status != "200 OK" {
+		t.Errorf("expected default status %q, got %q", "200 OK", wh.Status)
+	}
+
+	var cases = []struct {
+		code   int32
+		status string
+	}{
+		{418, "418 I'm a teapot"},
+		{599, "599"},
+	}
+
+	for _, c := range cases {
+		if s := i.xqd_resp_status_set(int32(whid), c.code); s != XqdStatusOK {
+			t.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+		}
+		if wh.StatusCode != int(c.code) || wh.Status != c.status {
+			t.Errorf("expected %d %q, got %d %q", c.code, c.status, wh.StatusCode, wh.Status)
+		}
+
+		if s := i.xqd_resp_status_get(int32(whid), 100); s != XqdStatusOK {
+			t.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+		}
+		if code := i.memory.Uint32(100); code != uint32(c.code) {
+			t.Errorf("expected status_get to return %d, got %d", c.code, code)
+		}
+	}
+}
+
+func TestResponseVersionSet(t *testing.T) {
+	i := newTestInstance(t)
+	whid, _ := i.responses.New()
+
+	for _, version := range []int32{Http09, Http10, Http11, Http2, Http3} {
+		if s := i.xqd_resp_version_set(int32(whid), version); s != XqdStatusOK {
+			t.Fatalf("version %d: expected status %d, got %d", version, XqdStatusOK, s)
+		}
+		if s := i.xqd_resp_version_get(int32(whid), 100); s != XqdStatusOK {
+			t.Fatalf("version %d: expected status %d, got %d", version, XqdStatusOK, s)
+		}
+		if v := int32(i.memory.Uint32(100)); v != version {
+			t.Errorf("expected version %d, got %d", version, v)
+		}
+	}
+
+	if s := i.xqd_resp_version_set(int32(whid), 42); s != XqdErrInvalidArgument {
+		t.Errorf("expected status %d for an unknown version, got %d", XqdErrInvalidArgument, s)
+	}
+}
+
+func TestResponseClose(t *testing.T) {
+	i := newTestInstance(t)
+	whid, wh := i.responses.New()
+
+	if s := i.xqd_resp_close(int32(whid)); s != XqdStatusOK || !wh.Close {
+		t.Errorf("expected status %d and the response marked closed, got %d (close=%t)", XqdStatusOK, s, wh.Close)
+	}
+	if s := i.xqd_resp_close(int32(whid + 1)); s != XqdErrInvalidHandle {
+		t.Errorf("expected status %d for an invalid handle, got %d", XqdErrInvalidHandle, s)
+	}
+}
@@ -0,0 +1,415 @@
+package fastlike
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestGettersZeroLength asserts that every getter called with an empty buffer reports how big of a
+// buffer it needs without writing any data, which is how guests discover the required size.
+func TestGettersZeroLength(t *testing.T) {
+	const (
+		name        = 100
+		buf         = 200
+		nwritten    = 300
+		cursor      = 400
+		uapNwritten = 500
+		canary      = 0xaa
+	)
+
+	i := newTestInstance(t,
+		WithDictionary("dict", func(_ string) string { return "dictionary value" }),
+		WithUserAgentParser(func(_ string) UserAgent {
+			return UserAgent{Family: "Firefox", Major: "76", Minor: "1", Patch: "15"}
+		}),
+	)
+
+	rhid, rh := i.requests.New()
+	rh.Method = "GET"
+	rh.URL, _ = url.Parse("http://localhost:1337/zero-length")
+	rh.Header = http.Header{"Test-Header": []string{"test-value"}}
+	whid, wh := i.responses.New()
+	wh.Header = http.Header{"Test-Header": []string{"test-value"}}
+
+	i.memory.WriteAt([]byte("test-header"), name)
+
+	var cases = []struct {
+		name     string
+		call     func() int32
+		nwritten int64
+		expected uint32
+	}{
+		{"req_method_get", func() int32 {
+			return i.xqd_req_method_get(int32(rhid), buf, 0, nwritten)
+		}, nwritten, 3},
+		{"req_uri_get", func() int32 {
+			return i.xqd_req_uri_get(int32(rhid), buf, 0, nwritten)
+		}, nwritten, uint32(len("http://localhost:1337/zero-length"))},
+		{"req_header_value_get", func() int32 {
+			return i.xqd_req_header_value_get(int32(rhid), name, 11, buf, 0, nwritten)
+		}, nwritten, 10},
+		{"req_header_names_get", func() int32 {
+			return i.xqd_req_header_names_get(int32(rhid), buf, 0, 0, cursor, nwritten)
+		}, nwritten, 12},
+		{"req_header_values_get", func() int32 {
+			return i.xqd_req_header_values_get(int32(rhid), name, 11, buf, 0, 0, cursor, nwritten)
+		}, nwritten, 11},
+		{"resp_header_names_get", func() int32 {
+			return i.xqd_resp_header_names_get(int32(whid), buf, 0, 0, cursor, nwritten)
+		}, nwritten, 12},
+		{"resp_header_values_get", func() int32 {
+			return i.xqd_resp_header_values_get(int32(whid), name, 11, buf, 0, 0, cursor, nwritten)
+		}, nwritten, 11},
+		{"dictionary_get", func() int32 {
+			return i.xqd_dictionary_get(0, name, 3, buf, 0, nwritten)
+		}, nwritten, 16},
+		{"uap_parse", func() int32 {
+			return i.xqd_uap_parse(name, 11,
+				buf, 0, uapNwritten,
+				buf, 0, uapNwritten+4,
+				buf, 0, uapNwritten+8,
+				buf, 0, uapNwritten+12,
+			)
+		}, uapNwritten, 7},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			i.memory.PutUint32(0, c.nwritten)
+			i.memory.PutUint8(canary, buf)
+
+			if s := c.call(); s != XqdErrBufferLength {
+				st.Errorf("expected status %d, got %d", XqdErrBufferLength, s)
+			}
+			if n := i.memory.Uint32(c.nwritten); n != c.expected {
+				st.Errorf("expected required length %d, got %d", c.expected, n)
+			}
+			if b := i.memory.ReadUint8(buf); b != canary {
+				st.Errorf("expected buffer to be untouched, got %#x", b)
+			}
+		})
+	}
+}
+
+func TestStrictABI(t *testing.T) {
+	// stubWat calls a stubbed method before responding with "Hello, world!"
+	const stubWat = `
+(module
+  (import "fastly_http_req" "downstream_tls_client_hello" (func $client_hello (param i32 i32 i32) (result i32)))
+  (import "fastly_http_resp" "new" (func $resp_new (param i32) (result i32)))
+  (import "fastly_http_body" "new" (func $body_new (param i32) (result i32)))
+  (import "fastly_http_body" "write" (func $body_write (param i32 i32 i32 i32 i32) (result i32)))
+  (import "fastly_http_resp" "send_downstream" (func $send_downstream (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 64) "Hello, world!")
+  (func (export "_start")
+    (drop (call $client_hello (i32.const 128) (i32.const 64) (i32.const 12)))
+    (drop (call $resp_new (i32.const 0)))
+    (drop (call $body_new (i32.const 4)))
+    (drop (call $body_write (i32.load (i32.const 4)) (i32.const 64) (i32.const 13) (i32.const 0) (i32.const 8)))
+    (drop (call $send_downstream (i32.load (i32.const 0)) (i32.load (i32.const 4)) (i32.const 0)))))
+`
+
+	r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+	w := serve(t, stubWat, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("permissive: expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:1337/", nil)
+	w = serve(t, stubWat, r, WithStrictABI())
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("strict: expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "unimplemented XQD method downstream_tls_client_hello") {
+		t.Errorf("strict: expected the method name in the response, got %q", w.Body.String())
+	}
+}
+
+func TestDownstreamBody(t *testing.T) {
+	var payload = strings.Repeat("fastlike", 1000)
+
+	var cases = []struct {
+		name   string
+		length int64
+	}{
+		{"content-length", int64(len(payload))},
+		{"chunked", -1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(st *testing.T) {
+			i := newTestInstance(st)
+			i.ds_request = httptest.NewRequest("POST", "http://localhost:1337/", strings.NewReader(payload))
+			i.ds_request.ContentLength = c.length
+
+			if s := i.xqd_req_body_downstream_get(100, 104); s != XqdStatusOK {
+				st.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+			}
+
+			var bhid = int32(i.memory.Uint32(104))
+			if size := i.bodies.Get(int(bhid)).Size(); size != c.length {
+				st.Errorf("expected body length %d, got %d", c.length, size)
+			}
+
+			// Read the body through the ABI in small chunks until EOF, which is a 0 byte read
+			var got []byte
+			for {
+				if s := i.xqd_body_read(bhid, 1024, 300, 108); s != XqdStatusOK {
+					st.Fatalf("body_read: expected status %d, got %d", XqdStatusOK, s)
+				}
+				var n = i.memory.Uint32(108)
+				if n == 0 {
+					break
+				}
+				got = append(got, i.memory.Data()[1024:1024+n]...)
+			}
+
+			if string(got) != payload {
+				st.Errorf("expected to read %d bytes of the body, got %d", len(payload), len(got))
+			}
+		})
+	}
+}
+
+func TestOriginalHeaders(t *testing.T) {
+	i := newTestInstance(t)
+	i.ds_request = httptest.NewRequest("GET", "http://localhost:1337/", nil)
+	i.ds_request.Header = http.Header{}
+	i.ds_request.Header.Add("x-Custom", "a")
+	i.ds_request.Header.Add("X-CUSTOM", "b")
+	i.ds_request.Header.Add("accept", "*/*")
+
+	if s := i.xqd_req_original_header_count(100); s != XqdStatusOK {
+		t.Fatalf("count: expected status %d, got %d", XqdStatusOK, s)
+	}
+	if count := i.memory.Uint32(100); count != 3 {
+		t.Errorf("count: expected 3 headers, got %d", count)
+	}
+
+	var names []string
+	for cursor := int64(0); cursor >= 0; cursor = int64(i.memory.Uint64(120)) {
+		if s := i.xqd_req_original_header_names_get(200, 256, int32(cursor), 120, 104); s != XqdStatusOK {
+			t.Fatalf("names_get: expected status %d, got %d", XqdStatusOK, s)
+		}
+		var buf = make([]byte, i.memory.Uint32(104))
+		i.memory.ReadAt(buf, 200)
+		names = append(names, strings.TrimRight(string(buf), "\x00"))
+	}
+	if strings.Join(names, ",") != "Accept,X-Custom,X-Custom" {
+		t.Errorf("names_get: unexpected names %q", names)
+	}
+
+	// Modifying the downstream request handle doesn't change the original headers
+	i.xqd_req_body_downstream_get(300, 304)
+	i.requests.Get(int(i.memory.Uint32(300))).Header.Del("accept")
+	i.xqd_req_original_header_count(100)
+	if count := i.memory.Uint32(100); count != 3 {
+		t.Errorf("count: expected 3 headers after modifying the request handle, got %d", count)
+	}
+
+	// Guests importing the methods with their ABI signatures can be instantiated
+	NewInstance(wat(t, `
+(module
+  (import "fastly_http_req" "original_header_names_get" (func (param i32 i32 i32 i32 i32) (result i32)))
+  (import "fastly_http_req" "original_header_count" (func (param i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "_start")))
+`)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestSendDownstreamContentLength(t *testing.T) {
+	// bigWat writes "Hello, world!" 1000 times, which is more than net/http buffers before it
+	// falls back to chunked encoding
+	const bigWat = `
+(module
+  (import "fastly_http_resp" "new" (func $resp_new (param i32) (result i32)))
+  (import "fastly_http_body" "new" (func $body_new (param i32) (result i32)))
+  (import "fastly_http_body" "write" (func $body_write (param i32 i32 i32 i32 i32) (result i32)))
+  (import "fastly_http_resp" "send_downstream" (func $send_downstream (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 64) "Hello, world!")
+  (func (export "_start")
+    (local $n i32)
+    (drop (call $resp_new (i32.const 0)))
+    (drop (call $body_new (i32.const 4)))
+    (loop $write
+      (drop (call $body_write (i32.load (i32.const 4)) (i32.const 64) (i32.const 13) (i32.const 0) (i32.const 8)))
+      (local.set $n (i32.add (local.get $n) (i32.const 1)))
+      (br_if $write (i32.lt_u (local.get $n) (i32.const 1000))))
+    (drop (call $send_downstream (i32.load (i32.const 0)) (i32.load (i32.const 4)) (i32.const 0)))))
+`
+
+	s := httptest.NewServer(newTestFastlike(t, bigWat))
+	defer s.Close()
+
+	res, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.ContentLength != 13000 {
+		t.Errorf("expected a content-length of 13000, got %d", res.ContentLength)
+	}
+	if len(res.TransferEncoding) != 0 {
+		t.Errorf("expected no transfer-encoding, got %q", res.TransferEncoding)
+	}
+	if body, _ := ioutil.ReadAll(res.Body); len(body) != 13000 {
+		t.Errorf("expected 13000 bytes of body, got %d", len(body))
+	}
+}
+
+func TestSendDownstreamHead(t *testing.T) {
+	i := newTestInstance(t)
+	w := httptest.NewRecorder()
+	i.ds_request = httptest.NewRequest("HEAD", "http://localhost:1337/", nil)
+	i.ds_response = w
+
+	whid, _ := i.responses.New()
+	bhid, bh := i.bodies.NewBuffer()
+	bh.Write([]byte("Hello, world!"))
+
+	if s := i.xqd_resp_send_downstream(int32(whid), int32(bhid), 0); s != XqdStatusOK {
+		t.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expected no body, got %q", w.Body.String())
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "13" {
+		t.Errorf("expected Content-Length 13, got %q", cl)
+	}
+
+	// Over a real connection too, where net/http refuses to write a body for HEAD
+	srv := httptest.NewServer(newTestFastlike(t, helloWat))
+	defer srv.Close()
+
+	resp, err := http.Head(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 13 {
+		t.Errorf("expected a 200 with Content-Length 13, got %d with %d", resp.StatusCode, resp.ContentLength)
+	}
+}
+
+func TestSendDownstreamStreaming(t *testing.T) {
+	i := newTestInstance(t)
+	w := httptest.NewRecorder()
+	i.ds_request = httptest.NewRequest("GET", "http://localhost:1337/", nil)
+	i.ds_response = w
+
+	whid, _ := i.responses.New()
+	bhid, bh := i.bodies.NewBuffer()
+	bh.Write([]byte("Hello, "))
+
+	if s := i.xqd_resp_send_downstream(int32(whid), int32(bhid), 1); s != XqdStatusOK {
+		t.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+	}
+
+	// What was written before sending goes out right away, without waiting for the rest
+	if !w.Flushed || w.Body.String() != "Hello, " {
+		t.Errorf("expected %q to be flushed, got %q (flushed=%t)", "Hello, ", w.Body.String(), w.Flushed)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "" {
+		t.Errorf("expected no Content-Length on a streamed response, got %q", cl)
+	}
+
+	// Writes after that go straight to the client
+	w.Flushed = false
+	i.memory.WriteAt([]byte("world!"), 100)
+	if s := i.xqd_body_write(int32(bhid), 100, 6, BodyWriteEndBack, 0); s != XqdStatusOK {
+		t.Fatalf("write: expected status %d, got %d", XqdStatusOK, s)
+	}
+	if !w.Flushed || w.Body.String() != "Hello, world!" {
+		t.Errorf("expected %q to be flushed, got %q (flushed=%t)", "Hello, world!", w.Body.String(), w.Flushed)
+	}
+
+	if s := i.xqd_body_close(int32(bhid)); s != XqdStatusOK {
+		t.Errorf("close: expected status %d, got %d", XqdStatusOK, s)
+	}
+}
+
+func TestSendDownstreamCompression(t *testing.T) {
+	var payload = strings.Repeat("Hello, world! ", 100)
+
+	// send sends payload downstream, with the given Accept-Encoding from the client and
+	// Content-Encoding from the program
+	var send = func(stream int32, accept, encoding string) *httptest.ResponseRecorder {
+		t.Helper()
+		i := newTestInstance(t, WithDownstreamCompression(true))
+		w := httptest.NewRecorder()
+		i.ds_request = httptest.NewRequest("GET", "http://localhost:1337/", nil)
+		if accept != "" {
+			i.ds_request.Header.Set("Accept-Encoding", accept)
+		}
+		i.ds_response = w
+
+		whid, wh := i.responses.New()
+		if encoding != "" {
+			wh.Header = http.Header{"Content-Encoding": {encoding}}
+		}
+		bhid, bh := i.bodies.NewBuffer()
+		bh.Write([]byte(payload))
+
+		if s := i.xqd_resp_send_downstream(int32(whid), int32(bhid), stream); s != XqdStatusOK {
+			t.Fatalf("expected status %d, got %d", XqdStatusOK, s)
+		}
+		i.reset()
+		return w
+	}
+
+	var gunzip = func(w *httptest.ResponseRecorder) string {
+		t.Helper()
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("expected a gzipped body, got %s", err.Error())
+		}
+		body, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("expected a complete gzipped body, got %s", err.Error())
+		}
+		return string(body)
+	}
+
+	for _, stream := range []int32{0, 1} {
+		w := send(stream, "br, gzip;q=0.8", "")
+		if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+			t.Errorf("stream=%d: expected Content-Encoding gzip, got %q", stream, ce)
+		}
+		if cl := w.Header().Get("Content-Length"); cl != "" {
+			t.Errorf("stream=%d: expected no Content-Length, got %q", stream, cl)
+		}
+		if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+			t.Errorf("stream=%d: expected Vary Accept-Encoding, got %q", stream, vary)
+		}
+		if body := gunzip(w); body != payload {
+			t.Errorf("stream=%d: expected the body to decompress to the payload, got %q", stream, body)
+		}
+	}
+
+	// Clients that don't accept gzip get the body as it is
+	for _, accept := range []string{"", "identity", "gzip;q=0"} {
+		w := send(0, accept, "")
+		if ce := w.Header().Get("Content-Encoding"); ce != "" || w.Body.String() != payload {
+			t.Errorf("accept %q: expected an unencoded body, got Content-Encoding %q", accept, ce)
+		}
+		if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(payload)) {
+			t.Errorf("accept %q: expected Content-Length %d, got %q", accept, len(payload), cl)
+		}
+	}
+
+	// Bodies the program already encoded aren't compressed again
+	w := send(0, "gzip", "br")
+	if ce := w.Header().Get("Content-Encoding"); ce != "br" || w.Body.String() != payload {
+		t.Errorf("expected the program's encoding to be left alone, got Content-Encoding %q", ce)
+	}
+}